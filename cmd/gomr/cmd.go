@@ -2,59 +2,307 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/golang/glog"
 	"github.com/tiwillia/gomr/pkg/gomr"
 )
 
 // This is where we start heh
+//   "gomr console" talks to the plugins from the terminal instead of IRC,
+//   see runConsole().
 func main() {
+	console := len(os.Args) > 1 && os.Args[1] == "console"
+	if console {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
+	configFile := flag.String("config", "", "YAML configuration file, see gomr.example.yaml. Environment variables and flags override it")
+
 	// Base Configuration
 	host := flag.String("host", "irc.freenode.net", "Hostname of the IRC server to connect to")
 	port := flag.String("port", "6667", "Port of the IRC server to connect to")
-	channel := flag.String("channel", "#test", "Name of the IRC channel to join")
+	channels := flag.String("channel", "#test", "Comma separated names of the IRC channels to join")
+	prefix := flag.String("prefix", "", "Command prefix that addresses the bot in channels without their own, e.g. !")
 	nick := flag.String("nick", "gomr", "Nickname of the IRC bot")
-	password := flag.String("password", "", "IRC channel password (if applicable)")
+	altNicks := flag.String("altnicks", "", "Comma separated nicknames to try if -nick is taken")
+	admins := flag.String("admins", "", "Comma separated accounts allowed to use admin commands")
+	password := flag.String("password", "", "IRC channel key for the -channel channels (if applicable)")
+	serverPassword := flag.String("serverpassword", "", "IRC server password (if applicable)")
+	nickServPassword := flag.String("nickservpassword", "", "Password to identify with NickServ (if applicable)")
+	waitForIdentify := flag.Bool("waitforidentify", false, "Wait for NickServ to confirm identification before joining channels")
+	factoidBlacklist := flag.String("factoidblacklist", "", "Comma separated words that are never factoids (defaults to why,where,who,when,how,now)")
 	wordnikAPIKey := flag.String("wordnikapikey", "", "Wordnik API key for dictionary lookup support")
+	useTLS := flag.Bool("tls", false, "Connect to the IRC server using TLS")
+	tlsCAFile := flag.String("tlscafile", "", "PEM file of CA certificates to trust in addition to the system roots")
+	tlsCertFile := flag.String("tlscertfile", "", "PEM client certificate for CertFP authentication")
+	tlsKeyFile := flag.String("tlskeyfile", "", "PEM private key for the client certificate (if not in -tlscertfile)")
+	tlsInsecure := flag.Bool("tlsinsecureskipverify", false, "Do not verify the IRC server's TLS certificate (insecure)")
+	saslMechanism := flag.String("saslmechanism", "", "SASL mechanism to authenticate with (PLAIN or EXTERNAL)")
+	saslUsername := flag.String("saslusername", "", "SASL account name (defaults to -nick)")
+	saslPassword := flag.String("saslpassword", "", "SASL password for the PLAIN mechanism")
+	sendBurst := flag.Int("sendburst", 5, "Number of lines that may be sent to the IRC server at once")
+	sendRate := flag.Float64("sendrate", 1, "Number of lines per second sent to the IRC server after a burst")
+	maxLines := flag.Int("maxlines", 0, "Number of lines of a long message sent before waiting for \"more\" (0 sends every line)")
+	pingInterval := flag.Int("pinginterval", 60, "Seconds between pings sent to the IRC server to measure lag")
+	pingTimeout := flag.Int("pingtimeout", 120, "Seconds the IRC server has to answer a ping before reconnecting")
+	plugins := flag.String("plugins", "", "Comma separated plugins to enable (all plugins if empty)")
+	pluginDir := flag.String("plugindir", "", "Directory of plugins (.so files) to load in addition to the built in ones")
+	pluginOrder := flag.String("pluginorder", "", "Comma separated plugins to offer messages to first, in order, e.g. factoid,karma")
+	workers := flag.Int("workers", 4, "Number of messages handled by plugins at once")
+	pluginTimeout := flag.Int("plugintimeout", 30, "Seconds a plugin has to handle a message")
+	maxRetries := flag.Int("maxretries", 0, "Number of consecutive reconnect attempts before giving up (0 retries forever)")
 	source := flag.String("source", "https://github.com/tiwillia/gomr", "Source link for contribution recommendations")
 
+	// Console configuration
+	consoleUser := flag.String("user", "tester", "Nickname console messages are sent from (console only)")
+
 	// Database configuration
+	dbDriver := flag.String("dbdriver", gomr.DriverMySQL, "Database driver to use, mysql or sqlite3 (console defaults to sqlite3)")
 	dbHost := flag.String("dbhost", "localhost", "Hostname of the mysql server to use")
 	dbPort := flag.String("dbport", "3306", "Port of the mysql server to use")
 	dbUsername := flag.String("dbusername", "gomr", "Username of the mysql user")
 	dbPassword := flag.String("dbpassword", "", "Password of the mysql user")
-	dbName := flag.String("dbname", "gomr", "Name of the mysql database")
+	dbName := flag.String("dbname", "gomr", "Name of the mysql database, or path of the sqlite3 database (console defaults to :memory:)")
 
 	flag.Parse()
 	glog.Infoln("Starting irc bot...")
 
-	config := gomr.Config{
-		Hostname:      *host,
-		Port:          *port,
-		Password:      *password,
-		Channel:       *channel,
-		Nick:          *nick,
-		Source:        *source,
-		WordnikAPIKey: *wordnikAPIKey,
+	// Read again on reload, see gomr.GomrService.Reload()
+	loadConfig := func() (*gomr.Config, *gomr.DbConfig, error) {
+		config := gomr.Config{
+			Hostname:   *host,
+			Port:       *port,
+			Channels:   channelConfigs(*channels, *password),
+			Prefix:     *prefix,
+			Nick:       *nick,
+			AltNicks:   splitList(*altNicks),
+			Admins:     splitList(*admins),
+			Source:     *source,
+			MaxRetries: *maxRetries,
+			SendBurst:  *sendBurst,
+			SendRate:   *sendRate,
+			MaxLines:   *maxLines,
+
+			PingInterval: *pingInterval,
+			PingTimeout:  *pingTimeout,
+			Plugins:      splitList(*plugins),
+			PluginDir:    *pluginDir,
+			PluginOrder:  splitList(*pluginOrder),
+
+			Workers:       *workers,
+			PluginTimeout: *pluginTimeout,
+
+			ServerPassword:   *serverPassword,
+			NickServPassword: *nickServPassword,
+			WaitForIdentify:  *waitForIdentify,
+
+			TLS:                   *useTLS,
+			TLSCAFile:             *tlsCAFile,
+			TLSCertFile:           *tlsCertFile,
+			TLSKeyFile:            *tlsKeyFile,
+			TLSInsecureSkipVerify: *tlsInsecure,
+
+			SASLMechanism: *saslMechanism,
+			SASLUsername:  *saslUsername,
+			SASLPassword:  *saslPassword,
+
+			FactoidBlacklist: splitList(*factoidBlacklist),
+			WordnikAPIKey:    *wordnikAPIKey,
+		}
+
+		dbConfig := gomr.DbConfig{
+			Driver:   *dbDriver,
+			Hostname: *dbHost,
+			Port:     *dbPort,
+			Username: *dbUsername,
+			Password: *dbPassword,
+			Name:     *dbName,
+		}
+
+		// Configuration is applied in order of precedence:
+		//   flag defaults < configuration file < environment variables < flags
+		if *configFile != "" {
+			if err := gomr.LoadConfigFile(*configFile, &config, &dbConfig); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		config.GetEnv()
+		dbConfig.GetEnv()
+
+		// Flags explicitly given on the command line override everything else
+		overrides := map[string]func(){
+			"host":                  func() { config.Hostname = *host },
+			"port":                  func() { config.Port = *port },
+			"channel":               func() { config.Channels = channelConfigs(*channels, *password) },
+			"prefix":                func() { config.Prefix = *prefix },
+			"password":              func() { setChannels(config.Channels, func(c *gomr.ChannelConfig) { c.Key = *password }) },
+			"nick":                  func() { config.Nick = *nick },
+			"altnicks":              func() { config.AltNicks = splitList(*altNicks) },
+			"admins":                func() { config.Admins = splitList(*admins) },
+			"source":                func() { config.Source = *source },
+			"maxretries":            func() { config.MaxRetries = *maxRetries },
+			"sendburst":             func() { config.SendBurst = *sendBurst },
+			"sendrate":              func() { config.SendRate = *sendRate },
+			"maxlines":              func() { config.MaxLines = *maxLines },
+			"pinginterval":          func() { config.PingInterval = *pingInterval },
+			"pingtimeout":           func() { config.PingTimeout = *pingTimeout },
+			"plugins":               func() { config.Plugins = splitList(*plugins) },
+			"plugindir":             func() { config.PluginDir = *pluginDir },
+			"pluginorder":           func() { config.PluginOrder = splitList(*pluginOrder) },
+			"workers":               func() { config.Workers = *workers },
+			"plugintimeout":         func() { config.PluginTimeout = *pluginTimeout },
+			"serverpassword":        func() { config.ServerPassword = *serverPassword },
+			"nickservpassword":      func() { config.NickServPassword = *nickServPassword },
+			"waitforidentify":       func() { config.WaitForIdentify = *waitForIdentify },
+			"tls":                   func() { config.TLS = *useTLS },
+			"tlscafile":             func() { config.TLSCAFile = *tlsCAFile },
+			"tlscertfile":           func() { config.TLSCertFile = *tlsCertFile },
+			"tlskeyfile":            func() { config.TLSKeyFile = *tlsKeyFile },
+			"tlsinsecureskipverify": func() { config.TLSInsecureSkipVerify = *tlsInsecure },
+			"saslmechanism":         func() { config.SASLMechanism = *saslMechanism },
+			"saslusername":          func() { config.SASLUsername = *saslUsername },
+			"saslpassword":          func() { config.SASLPassword = *saslPassword },
+			"factoidblacklist":      func() { config.FactoidBlacklist = splitList(*factoidBlacklist) },
+			"wordnikapikey":         func() { config.WordnikAPIKey = *wordnikAPIKey },
+			"dbdriver":              func() { dbConfig.Driver = *dbDriver },
+			"dbhost":                func() { dbConfig.Hostname = *dbHost },
+			"dbport":                func() { dbConfig.Port = *dbPort },
+			"dbusername":            func() { dbConfig.Username = *dbUsername },
+			"dbpassword":            func() { dbConfig.Password = *dbPassword },
+			"dbname":                func() { dbConfig.Name = *dbName },
+		}
+
+		// The console doesn't need MySQL, unless asked for it on the command line
+		if console {
+			dbConfig.Driver, dbConfig.Name = gomr.DriverSQLite, ":memory:"
+		}
+
+		flag.Visit(func(f *flag.Flag) {
+			if override, ok := overrides[f.Name]; ok {
+				override()
+			}
+		})
+
+		// Passwords may be given as file: or env: references, see gomr.ReadSecret
+		if err := config.ReadSecrets(); err != nil {
+			return nil, nil, fmt.Errorf("Invalid configuration: %s", err)
+		}
+		if err := dbConfig.ReadSecrets(); err != nil {
+			return nil, nil, fmt.Errorf("Invalid database configuration: %s", err)
+		}
+
+		// Plugins are loaded before validating, so they can be enabled by name.
+		//   New plugins in the directory are loaded on reload.
+		if config.PluginDir != "" {
+			if err := gomr.LoadPlugins(config.PluginDir); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		// The IRC settings don't matter to the console
+		if !console {
+			if err := config.Validate(); err != nil {
+				return nil, nil, err
+			}
+		}
+		if err := dbConfig.Validate(); err != nil {
+			return nil, nil, err
+		}
+		return &config, &dbConfig, nil
 	}
 
-	dbConfig := gomr.DbConfig{
-		Hostname: *dbHost,
-		Port:     *dbPort,
-		Username: *dbUsername,
-		Password: *dbPassword,
-		Name:     *dbName,
+	config, dbConfig, err := loadConfig()
+	if err != nil {
+		glog.Fatalln(err)
 	}
-	// Overwrite provided database configuration with environment variables
-	dbConfig.GetEnv()
 
-	gomrService, err := gomr.NewGomrService(&config, &dbConfig)
+	gomrService, err := gomr.NewGomrService(config, dbConfig)
 	if err != nil {
 		glog.Fatalf("Unable to create Gomr service: %s", err)
 	}
 
+	// Changes to the database configuration need a restart
+	gomrService.Reloader = func() (*gomr.Config, error) {
+		config, _, err := loadConfig()
+		return config, err
+	}
+	go reloadOnHangup(gomrService)
+
+	if console {
+		err = runConsole(gomrService, *consoleUser)
+		if err != nil {
+			glog.Fatalf("Error reading from the console: %s", err)
+		}
+		return
+	}
+
 	err = gomrService.Run()
 	if err != nil {
 		glog.Fatalf("Error encountered running Gomr service: %s", err)
 	}
 }
+
+// Read messages from stdin as if user said them in the first configured
+//   channel, and print the bot's replies
+func runConsole(service *gomr.GomrService, user string) error {
+	console := &gomr.Console{
+		BotNick: service.Config.Nick,
+		User:    user,
+		In:      os.Stdin,
+		Out:     os.Stdout,
+	}
+	if len(service.Config.Channels) > 0 {
+		console.Channel = service.Config.Channels[0].Name
+	}
+
+	to := console.Channel
+	if to == "" {
+		to = console.BotNick
+	}
+	fmt.Printf("Talking to %s as %s in %s, end with Ctrl-D. Try \"%s: help\".\n", console.BotNick, user, to, console.BotNick)
+	return console.Run(service.HandleMessage)
+}
+
+// Reload the configuration whenever we receive SIGHUP
+func reloadOnHangup(service *gomr.GomrService) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		glog.Infoln("Received SIGHUP, reloading the configuration")
+		if err := service.Reload(); err != nil {
+			glog.Infoln("ERROR: Unable to reload the configuration:", err)
+		}
+	}
+}
+
+// Build the configuration for each channel in a comma separated list
+func channelConfigs(channels, key string) (configs []gomr.ChannelConfig) {
+	for _, name := range splitList(channels) {
+		configs = append(configs, gomr.ChannelConfig{Name: name, Key: key})
+	}
+	return configs
+}
+
+// Split a comma separated list, ignoring empty items
+func splitList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Change a setting for every configured channel
+func setChannels(channels []gomr.ChannelConfig, set func(*gomr.ChannelConfig)) {
+	for i := range channels {
+		set(&channels[i])
+	}
+}
@@ -0,0 +1,61 @@
+package gomr
+
+// Sent with our WHOX requests, so we only parse replies to them
+const whoxToken = "734"
+
+// Identity returns the name a user's karma and other records should be
+//   kept under: their account if they are logged in, so changing nick
+//   doesn't make them someone else. Otherwise it is their current nick,
+//   canonicalized, as nothing proves a nick still belongs to the same person.
+func (s *State) Identity(nick string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u := s.users[CanonicalizeIrcNick(nick)]
+	if u == nil || u.Account == "" {
+		return CanonicalizeIrcNick(nick)
+	}
+	return CanonicalizeIrcNick(u.Account)
+}
+
+// Account returns the account nick is logged in to, if known
+func (c *Connection) Account(nick string) string {
+	u, _ := c.State.User(nick)
+	return u.Account
+}
+
+func (s *State) hasWHOX() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.whox
+}
+
+// IsAdmin returns true if nick is logged in to one of the configured admin
+//   accounts. Nicks alone can't be trusted, so without accounts from the
+//   server nobody is an admin.
+func (c *Connection) IsAdmin(nick string) bool {
+	u, ok := c.State.User(nick)
+	if !ok || u.Account == "" {
+		return false
+	}
+	for _, admin := range c.settings().Admins {
+		if CanonicalizeIrcNick(admin) == CanonicalizeIrcNick(u.Account) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ask for the accounts of everyone in a channel we just joined. Joins and
+//   account changes after that are seen through extended-join and
+//   account-notify.
+func (c *Connection) updateAccounts(msg *Message) {
+	if msg.Command != "JOIN" || !c.IsMe(msg.Nick) || !c.State.hasWHOX() {
+		return
+	}
+	channel := msg.Param(0)
+	if !ValidTarget(channel) {
+		return
+	}
+	c.Send("WHO " + channel + " %tcuhnfa," + whoxToken)
+}
@@ -0,0 +1,54 @@
+package gomr
+
+import "testing"
+
+// Update c's state from lines received from the server
+func receive(t *testing.T, c *Connection, lines ...string) {
+	for _, line := range lines {
+		msg, err := ParseMessage(line)
+		if err != nil {
+			t.Fatalf("ParseMessage(%q) returned an error: %s", line, err)
+		}
+		c.update(msg)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	c, read := pipeConnection(t)
+	c.config.Admins = []string{"TimAccount"}
+	receive(t, c,
+		":irc.example.com 005 gomr WHOX :are supported by this server",
+		":gomr!gomr@example.com JOIN #test",
+	)
+	if lines := read(1); lines[0] != "WHO #test %tcuhnfa,"+whoxToken+"\r\n" {
+		t.Fatalf("Sent %q after joining, want a WHOX request", lines[0])
+	}
+	receive(t, c,
+		":irc.example.com 353 gomr = #test :gomr tim bob",
+		":irc.example.com 354 gomr "+whoxToken+" #test ~tim tim.example.com tim H TimAccount",
+		":irc.example.com 354 gomr "+whoxToken+" #test ~bob bob.example.com bob H 0",
+		":tim!~tim@tim.example.com NICK :timbo",
+		// Someone else takes bob's nick after bob changes it
+		":bob!~bob@bob.example.com NICK :alice",
+		":bob!~eve@eve.example.com JOIN #test",
+	)
+
+	tests := []struct{ nick, identity string }{
+		{"TIMBO", "timaccount"},
+		{"alice", "alice"},
+		{"Bob", "bob"},
+		{"Stranger", "stranger"},
+	}
+	for _, test := range tests {
+		if identity := c.State.Identity(test.nick); identity != test.identity {
+			t.Errorf("Identity(%q) = %q, want %q", test.nick, identity, test.identity)
+		}
+	}
+
+	if !c.IsAdmin("timbo") {
+		t.Error("timbo is logged in to an admin account, but isn't an admin")
+	}
+	if c.IsAdmin("tim") || c.IsAdmin("bob") {
+		t.Error("Users not logged in to an admin account are admins")
+	}
+}
@@ -0,0 +1,44 @@
+package gomr
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff calculates jittered exponential delays between reconnect attempts.
+//   Each call to Next() doubles the delay, up to Max. The returned delay is
+//   randomized between half and all of that value so that many bots
+//   disconnected by the same netsplit don't all reconnect at once.
+type Backoff struct {
+	Min      time.Duration
+	Max      time.Duration
+	attempts int
+}
+
+// Next returns how long to wait before the next attempt
+func (b *Backoff) Next() time.Duration {
+	delay := b.Min
+	for i := 0; i < b.attempts && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+	b.attempts++
+
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
+
+// Attempts returns the number of times Next() has been called since the last Reset()
+func (b *Backoff) Attempts() int {
+	return b.attempts
+}
+
+// Reset should be called once a connection has been successfully established
+func (b *Backoff) Reset() {
+	b.attempts = 0
+}
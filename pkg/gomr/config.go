@@ -0,0 +1,219 @@
+package gomr
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// This struct defines the layout of the yaml configuration file,
+//   see gomr.example.yaml
+type ConfigFile struct {
+	Config   Config   `yaml:"irc"`
+	DbConfig DbConfig `yaml:"database"`
+}
+
+// LoadConfigFile reads the yaml file at path over the provided configuration.
+//   Settings missing from the file are left untouched, so defaults can be
+//   set before loading. Unknown settings in the file are an error.
+func LoadConfigFile(path string, config *Config, dbConfig *DbConfig) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New("Unable to read configuration file: " + err.Error())
+	}
+
+	file := ConfigFile{Config: *config, DbConfig: *dbConfig}
+	err = yaml.UnmarshalStrict(contents, &file)
+	if err != nil {
+		return fmt.Errorf("Unable to parse configuration file %s: %s", path, err)
+	}
+
+	*config = file.Config
+	*dbConfig = file.DbConfig
+	return nil
+}
+
+func (c *Config) GetEnv() {
+	// Set irc configuration via env variables if they exist
+	//  Environment variables take precedence over the configuration file
+	if e := os.Getenv("GOMR_HOSTNAME"); e != "" {
+		c.Hostname = e
+	}
+	if e := os.Getenv("GOMR_PORT"); e != "" {
+		c.Port = e
+	}
+	if e := os.Getenv("GOMR_NICK"); e != "" {
+		c.Nick = e
+	}
+	if e := os.Getenv("GOMR_CHANNELS"); e != "" {
+		// Only the names can be set from the environment, keep the rest of
+		//   the configuration for channels that are already known.
+		var channels []ChannelConfig
+		for _, name := range strings.Split(e, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if cc := c.ChannelConfig(name); cc != nil {
+				channels = append(channels, *cc)
+			} else {
+				channels = append(channels, ChannelConfig{Name: name})
+			}
+		}
+		c.Channels = channels
+	}
+	if e := os.Getenv("GOMR_SERVER_PASSWORD"); e != "" {
+		c.ServerPassword = e
+	}
+	if e := os.Getenv("GOMR_NICKSERV_PASSWORD"); e != "" {
+		c.NickServPassword = e
+	}
+	if e := os.Getenv("GOMR_SASL_PASSWORD"); e != "" {
+		c.SASLPassword = e
+	}
+	if e := os.Getenv("GOMR_WORDNIK_API_KEY"); e != "" {
+		c.WordnikAPIKey = e
+	}
+}
+
+// Validate checks the configuration for mistakes, returning an error
+//   describing every problem found.
+func (c *Config) Validate() error {
+	var problems []string
+
+	if c.Hostname == "" {
+		problems = append(problems, "hostname must be set to the IRC server to connect to")
+	}
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("port %q must be a number between 1 and 65535", c.Port))
+	}
+	if c.Nick == "" {
+		problems = append(problems, "nick must be set")
+	} else if !validNick(c.Nick) {
+		problems = append(problems, fmt.Sprintf("nick %q is not a valid IRC nickname", c.Nick))
+	}
+
+	for _, nick := range c.AltNicks {
+		if !validNick(nick) {
+			problems = append(problems, fmt.Sprintf("alternative nick %q is not a valid IRC nickname", nick))
+		}
+	}
+
+	if len(c.Channels) == 0 {
+		problems = append(problems, "at least one channel must be configured")
+	}
+	for _, channel := range c.Channels {
+		if !IsChannel(channel.Name) || strings.ContainsAny(channel.Name, " ,\x07") {
+			problems = append(problems, fmt.Sprintf("channel %q is not a valid IRC channel name (e.g. #gomr)", channel.Name))
+		}
+		if strings.ContainsAny(channel.Key, " ,") {
+			problems = append(problems, fmt.Sprintf("the key for channel %s may not contain spaces or commas", channel.Name))
+		}
+		for _, name := range channel.Plugins {
+			if !c.pluginExists(name) {
+				problems = append(problems, fmt.Sprintf("channel %s enables unknown plugin %q", channel.Name, name))
+			}
+		}
+	}
+
+	for _, name := range c.Plugins {
+		if !c.pluginExists(name) {
+			problems = append(problems, fmt.Sprintf("unknown plugin %q, available plugins are: %s", name, strings.Join(RegisteredPlugins(), ", ")))
+		}
+	}
+	names := make(map[string]bool)
+	for _, ext := range c.ExternalPlugins {
+		name := strings.ToLower(ext.Name)
+		if name == "" || ext.Command == "" {
+			problems = append(problems, "external plugins must have a name and a command")
+		} else if _, ok := lookupPlugin(name); ok || names[name] {
+			problems = append(problems, fmt.Sprintf("external plugin %q has the name of another plugin", ext.Name))
+		}
+		names[name] = true
+	}
+
+	if c.TLSKeyFile != "" && c.TLSCertFile == "" {
+		problems = append(problems, "tlskeyfile requires tlscertfile to be set")
+	}
+	if (c.TLSCAFile != "" || c.TLSCertFile != "" || c.TLSInsecureSkipVerify) && !c.TLS {
+		problems = append(problems, "tls must be enabled to use tlscafile, tlscertfile or tlsinsecureskipverify")
+	}
+
+	switch strings.ToUpper(c.SASLMechanism) {
+	case "":
+	case SASLPlain:
+		if c.SASLPassword == "" {
+			problems = append(problems, "saslpassword must be set to use SASL PLAIN")
+		}
+	case SASLExternal:
+		if c.TLSCertFile == "" {
+			problems = append(problems, "tlscertfile must be set to use SASL EXTERNAL")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("saslmechanism %q must be PLAIN or EXTERNAL", c.SASLMechanism))
+	}
+
+	if c.SendBurst < 0 || c.SendRate < 0 {
+		problems = append(problems, "sendburst and sendrate may not be negative")
+	}
+	if c.MaxLines < 0 {
+		problems = append(problems, "maxlines may not be negative")
+	}
+	if c.PingInterval < 0 || c.PingTimeout < 0 {
+		problems = append(problems, "pinginterval and pingtimeout may not be negative")
+	}
+	if c.Workers < 0 || c.PluginTimeout < 0 {
+		problems = append(problems, "workers and plugintimeout may not be negative")
+	}
+	if c.MaxRetries < 0 {
+		problems = append(problems, "maxretries may not be negative")
+	}
+
+	return configError("irc", problems)
+}
+
+// Validate checks the database configuration for mistakes, returning an error
+//   describing every problem found.
+func (d *DbConfig) Validate() error {
+	var problems []string
+
+	switch d.Driver {
+	case "", DriverMySQL:
+		if d.Hostname == "" {
+			problems = append(problems, "hostname must be set to the mysql server to connect to")
+		}
+		if port, err := strconv.Atoi(d.Port); err != nil || port < 1 || port > 65535 {
+			problems = append(problems, fmt.Sprintf("port %q must be a number between 1 and 65535", d.Port))
+		}
+		if d.Username == "" {
+			problems = append(problems, "username must be set")
+		}
+		if d.Name == "" {
+			problems = append(problems, "name must be set to the database to use")
+		}
+	case DriverSQLite:
+		if d.Name == "" {
+			problems = append(problems, "name must be set to the database file to use, or :memory:")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("driver %q must be %s or %s", d.Driver, DriverMySQL, DriverSQLite))
+	}
+
+	return configError("database", problems)
+}
+
+func validNick(nick string) bool {
+	return nick != "" && !strings.ContainsAny(nick, " ,*?!@#:"+lineBreakers) && !strings.ContainsAny(nick[:1], "0123456789-")
+}
+
+func configError(section string, problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Invalid %s configuration:\n  %s", section, strings.Join(problems, "\n  "))
+}
@@ -1,47 +1,327 @@
 package gomr
 
 import (
+	"bufio"
+	"crypto/tls"
 	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
 )
 
+// How long to wait for the server to accept a connection
+const dialTimeout = 30 * time.Second
+
 type Connection struct {
 	Hostname string
 	Port     string
-	Channel  string
-	Nick     string
+	Channels []ChannelConfig
 	Conn     net.Conn
+	State    *State // The channels we are in, and who is in them
+
+	reader    *bufio.Reader
+	config    *Config
+	queue     *sendQueue
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Protects the fields below, which are updated as messages are read
+	mu           sync.Mutex
+	nick         string
+	user         string
+	host         string
+	registered   bool
+	nickAttempts int
+	caps         map[string]bool     // Capabilities enabled by the server
+	more         map[string][]string // Lines waiting for More(), by target
+
+	// Our unanswered PING, if any, and the lag measured by the last one
+	pingToken string
+	pingSent  time.Time
+	lag       time.Duration
+	lagKnown  bool
 }
 
-func NewConnection(host, port, channel, nick string) (c *Connection, err error) {
-	co := Connection{Hostname: host,
-		Port:    port,
-		Channel: channel,
-		Nick:    nick}
+func NewConnection(config *Config) (c *Connection, err error) {
+	hostStr := net.JoinHostPort(config.Hostname, config.Port)
+	dialer := &net.Dialer{Timeout: dialTimeout}
 
-	hostStr := co.Hostname + ":" + co.Port
-	co.Conn, err = net.Dial("tcp", hostStr)
+	var conn net.Conn
+	if config.TLS {
+		var tlsConfig *tls.Config
+		tlsConfig, err = config.TLSConfig()
+		if err != nil {
+			return
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostStr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", hostStr)
+	}
 	if err != nil {
 		return
 	}
-	co.Send("USER " + co.Nick + " 0 * " + co.Nick)
-	co.Send("NICK " + co.Nick)
-	co.Send("JOIN " + co.Channel)
+	co := newConnection(conn, config)
+
+	err = co.register()
+	if err != nil {
+		co.Close()
+		return nil, err
+	}
+	go co.pingLoop()
+	return co, nil
+}
+
+// Wrap an established connection to the server, and start writing to it
+func newConnection(conn net.Conn, config *Config) *Connection {
+	c := &Connection{Hostname: config.Hostname,
+		Port:     config.Port,
+		Channels: config.Channels,
+		Conn:     conn,
+		State:    newState(),
+		reader:   bufio.NewReader(conn),
+		config:   config,
+		queue:    newSendQueue(),
+		closed:   make(chan struct{}),
+		nick:     config.Nick,
+		caps:     make(map[string]bool),
+		more:     make(map[string][]string)}
+	go c.writeLoop()
+	return c
+}
+
+// Close the connection to the server. Lines still waiting to be sent are dropped.
+func (c *Connection) Close() (err error) {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.Conn.Close()
+	})
+	return
+}
+
+// Write queued lines to the server as fast as flood protection allows
+func (c *Connection) writeLoop() {
+	config := c.settings()
+	limiter := newTokenBucket(config.SendBurst, config.SendRate)
+	for {
+		select {
+		case <-c.queue.ready:
+		case <-c.closed:
+			return
+		}
+
+		// Reconfigure() may have changed the flood protection
+		if latest := c.settings(); latest.SendBurst != config.SendBurst || latest.SendRate != config.SendRate {
+			config = latest
+			limiter = newTokenBucket(config.SendBurst, config.SendRate)
+		}
+
+		for c.queue.waiting() {
+			if !limiter.wait(c.closed) {
+				return
+			}
+			line, ok := c.queue.pop()
+			if !ok {
+				break
+			}
+			// Everything should have been sanitized already, but a line break
+			//   here would let the rest of the line be sent as a new command
+			_, err := c.Conn.Write([]byte(sanitizeLine(line) + "\r\n"))
+			if err != nil {
+				glog.Infoln("ERROR: Unable to write to server:", err)
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// ReadLine blocks until a full line is received from the server
+func (c *Connection) ReadLine() (string, error) {
+	return c.reader.ReadString('\n')
+}
+
+// ReadMessage blocks until a full line is received from the server and parses it.
+//   Lines that can't be parsed are logged and skipped.
+func (c *Connection) ReadMessage() (*Message, error) {
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		msg, err := ParseMessage(line)
+		if err != nil {
+			glog.Infoln("ERROR: Unable to parse line from server:", err)
+			continue
+		}
+		c.update(msg)
+		return msg, nil
+	}
+}
+
+// Keep track of how the server sees us from the messages it sends
+func (c *Connection) update(msg *Message) {
+	c.State.update(msg, c.IsMe)
+	c.updateAccounts(msg)
+	c.updateMask(msg)
+	c.updateNick(msg)
+	c.updatePing(msg)
+}
+
+func (c *Connection) updateMask(msg *Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	self := CanonicalizeIrcNick(msg.Nick) == CanonicalizeIrcNick(c.nick)
+
+	switch msg.Command {
+	case "JOIN":
+		// The server echoes our own JOINs with our full mask
+		if self && msg.User != "" && msg.Host != "" {
+			c.user, c.host = msg.User, msg.Host
+		}
+	case "CHGHOST":
+		if self {
+			c.user, c.host = msg.Param(0), msg.Param(1)
+		}
+	case "396":
+		// RPL_VISIBLEHOST, our host was cloaked
+		c.host = msg.Param(1)
+	}
+}
+
+// HasCap returns true if the server enabled the named IRCv3 capability
+func (c *Connection) HasCap(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.caps[name]
+}
+
+func (c *Connection) enableCaps(names []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range names {
+		// A leading '-' means the capability was disabled
+		if strings.HasPrefix(name, "-") {
+			delete(c.caps, name[1:])
+		} else {
+			c.caps[name] = true
+		}
+	}
+}
 
-	return &co, err
+// Identify with NickServ, if a NickServ password is configured.
+//   This must be called once the server has accepted our registration.
+func (c *Connection) Identify() {
+	config := c.settings()
+	if config.NickServPassword == "" {
+		return
+	}
+	glog.Infoln("Identifying with NickServ as", config.Nick)
+	// Not sent with SendTo(), which could hold part of it back for More()
+	c.sendSecret("PRIVMSG NickServ :IDENTIFY " + config.Nick + " " + config.NickServPassword)
 }
 
-// Send the server a message
+// Send the server a message. These are sent before any queued PRIVMSGs.
+//   Line breaks are removed, so only a single line can be sent.
 func (c *Connection) Send(text string) {
-	//      log.Fprintf(conn, text)
-	c.Conn.Write([]byte(text + "\n"))
+	line := sanitizeLine(text)
+	if line != text {
+		glog.Infoln("WARNING: Removed line breaks from line sent to server:", line)
+	}
+	c.queue.pushPriority(line)
+}
+
+// Send a line carrying a password, like Send() but without logging it
+func (c *Connection) sendSecret(text string) {
+	line := sanitizeLine(text)
+	if line != text {
+		glog.Infoln("WARNING: Removed line breaks from a line with a password sent to server")
+	}
+	c.queue.pushPriority(line)
 }
 
-// Identity can either be a channel or a nick
+// Identity can either be a channel or a nick. Text too long for a single
+//   line is split into several, see Connection.page()
+// Line breaks in text are replaced with spaces.
 func (c *Connection) SendTo(identity, text string) {
-	c.Conn.Write([]byte("PRIVMSG " + identity + " :" + text + "\n"))
+	if !ValidTarget(identity) {
+		glog.Infof("ERROR: Refusing to send to invalid target %q: %s", identity, sanitizeText(text))
+		return
+	}
+	for _, line := range c.page(identity, sanitizeText(text)) {
+		c.queue.push(identity, "PRIVMSG "+identity+" :"+line)
+	}
 }
 
-// Send the configured channel a message
+// Send every configured channel a message
 func (c *Connection) SendChan(text string) {
-	c.Conn.Write([]byte("PRIVMSG " + c.Channel + " :" + text + "\n"))
+	c.mu.Lock()
+	channels := c.Channels
+	c.mu.Unlock()
+	for _, channel := range channels {
+		c.SendTo(channel.Name, text)
+	}
+}
+
+// Join a channel, using its key if it has one
+func (c *Connection) Join(channel ChannelConfig) {
+	if !ValidTarget(channel.Name) || strings.ContainsAny(channel.Key, " ,"+lineBreakers) {
+		glog.Infof("ERROR: Refusing to join invalid channel %q", channel.Name)
+		return
+	}
+	if channel.Key != "" {
+		c.Send("JOIN " + channel.Name + " " + channel.Key)
+	} else {
+		c.Send("JOIN " + channel.Name)
+	}
+}
+
+// Leave a channel
+func (c *Connection) Part(channel string) {
+	if !IsChannel(channel) || !ValidTarget(channel) {
+		glog.Infof("ERROR: Refusing to part invalid channel %q", channel)
+		return
+	}
+	c.Send("PART " + channel)
+}
+
+// Reconfigure applies a reloaded configuration, see GomrService.Reload().
+//   Channels added to it are joined and those removed from it are left.
+//   New flood protection settings start over with a full burst. Settings
+//   used to connect take effect on the next connection.
+func (c *Connection) Reconfigure(config *Config) {
+	c.mu.Lock()
+	old := c.Channels
+	c.config, c.Channels = config, config.Channels
+	c.mu.Unlock()
+
+	for _, channel := range config.Channels {
+		if !hasChannel(old, channel.Name) {
+			glog.Infoln("Joining", channel.Name)
+			c.Join(channel)
+		}
+	}
+	for _, channel := range old {
+		if !hasChannel(config.Channels, channel.Name) {
+			glog.Infoln("Leaving", channel.Name)
+			c.Part(channel.Name)
+		}
+	}
+}
+
+// The configuration, which Reconfigure() may replace
+func (c *Connection) settings() *Config {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.config
+}
+
+func hasChannel(channels []ChannelConfig, name string) bool {
+	for _, channel := range channels {
+		if CanonicalizeIrcNick(channel.Name) == CanonicalizeIrcNick(name) {
+			return true
+		}
+	}
+	return false
 }
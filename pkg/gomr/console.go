@@ -0,0 +1,126 @@
+package gomr
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Console is a Transport for trying out plugins without a chat server. Each
+//   line read from In is treated as a message from User to Channel (or to
+//   the bot, if Channel is empty), and the bot's replies are written to Out.
+type Console struct {
+	BotNick string // Messages are matched against this, as with the IRC nick
+	User    string
+	Channel string
+	In      io.Reader
+	Out     io.Writer
+
+	mu sync.Mutex // Serializes writes to Out
+}
+
+// Run reads lines until In is exhausted, passing each to handle as a
+//   message. Returns nil at the end of In.
+func (c *Console) Run(handle func(*Message, Transport)) error {
+	scanner := bufio.NewScanner(c.In)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		handle(c.message(line), c)
+	}
+	return scanner.Err()
+}
+
+// Wrap a line typed at the console in a message, as if it came from IRC
+func (c *Console) message(text string) *Message {
+	target := c.Channel
+	if target == "" {
+		target = c.BotNick
+	}
+	return &Message{
+		Prefix:  c.User + "!" + c.User + "@console",
+		Nick:    c.User,
+		User:    c.User,
+		Host:    "console",
+		Command: "PRIVMSG",
+		Params:  []string{target, text},
+	}
+}
+
+func (c *Console) Nick() string {
+	return c.BotNick
+}
+
+func (c *Console) IsMe(nick string) bool {
+	return CanonicalizeIrcNick(nick) == CanonicalizeIrcNick(c.BotNick)
+}
+
+func (c *Console) IsChannel(name string) bool {
+	return IsChannel(name)
+}
+
+func (c *Console) Identity(nick string) string {
+	return CanonicalizeIrcNick(nick)
+}
+
+// Nobody at the console is logged in
+func (c *Console) Account(nick string) string {
+	return ""
+}
+
+// Whoever is at the console is trusted with admin commands
+func (c *Console) IsAdmin(nick string) bool {
+	return CanonicalizeIrcNick(nick) == CanonicalizeIrcNick(c.User)
+}
+
+// The console's channel has just the bot and the user in it
+func (c *Console) Members(channel string) []Member {
+	if c.Channel == "" || CanonicalizeIrcNick(channel) != CanonicalizeIrcNick(c.Channel) {
+		return nil
+	}
+	members := []Member{
+		{User: User{Nick: c.BotNick, User: c.BotNick, Host: "console"}},
+		{User: User{Nick: c.User, User: c.User, Host: "console"}},
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return CanonicalizeIrcNick(members[i].Nick) < CanonicalizeIrcNick(members[j].Nick)
+	})
+	return members
+}
+
+func (c *Console) InChannel(channel, nick string) bool {
+	for _, m := range c.Members(channel) {
+		if CanonicalizeIrcNick(m.Nick) == CanonicalizeIrcNick(nick) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Console) SendTo(target, text string) {
+	c.printf("[%s] <%s> %s\n", target, c.BotNick, text)
+}
+
+func (c *Console) SendPrivate(nick, text string) {
+	c.printf("[%s] <%s> %s\n", nick, c.BotNick, text)
+}
+
+func (c *Console) SendAction(target, text string) {
+	c.printf("[%s] * %s %s\n", target, c.BotNick, text)
+}
+
+// Nothing is held back at the console
+func (c *Console) More(target string) bool {
+	return false
+}
+
+func (c *Console) printf(format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.Out, format, args...)
+}
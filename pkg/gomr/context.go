@@ -0,0 +1,87 @@
+package gomr
+
+import (
+	"context"
+	"regexp"
+	"strings"
+)
+
+// Context is a message passed to plugins, along with what gomr knows about
+//   it and how to reply. The message's fields (Nick, Host, Tags, ...) can be
+//   used directly.
+//   It is also a context.Context, done when the plugin's time is up (see
+//   Config.PluginTimeout), to pass to anything slow like HttpGetContext().
+type Context struct {
+	context.Context
+	*Message
+	Transport Transport
+
+	Sender    string // Nick of whoever sent the message
+	Account   string // The sender's account, if they are logged in and the server tells us
+	Channel   string // Where replies go, the channel or the sender of a private message
+	Namespace string // For karma and factoids, see ChannelConfig.Namespace
+
+	// Private messages are always addressed to us, channel messages are if
+	//   they start with our nick (e.g. "gomr: rank") or the command prefix
+	//   (e.g. "!rank"). Stripped is the text without the nick or prefix.
+	Private   bool
+	Addressed bool
+	Stripped  string
+}
+
+// Build the context for a message received through t
+func NewContext(msg *Message, t Transport, config *Config) *Context {
+	ctx := &Context{
+		Context:   context.Background(),
+		Message:   msg,
+		Transport: t,
+		Sender:    msg.Nick,
+		Channel:   msg.ReplyTarget(t.Nick()),
+	}
+	ctx.Private = !t.IsChannel(msg.Target())
+	ctx.Account = t.Account(msg.Nick)
+	ctx.Namespace = config.Namespace(ctx.Channel)
+
+	if msg.Command != "PRIVMSG" {
+		return ctx
+	}
+	text := strings.TrimSpace(msg.Trailing())
+	ctx.Stripped = text
+
+	prefix := config.CommandPrefix(ctx.Channel)
+	if rest, ok := addressedTo(text, t.Nick()); ok {
+		ctx.Addressed, ctx.Stripped = true, rest
+	} else if prefix != "" && strings.HasPrefix(text, prefix) && len(text) > len(prefix) {
+		ctx.Addressed, ctx.Stripped = true, strings.TrimSpace(text[len(prefix):])
+	} else if ctx.Private {
+		ctx.Addressed = true
+	}
+	return ctx
+}
+
+// Reply in the channel the message came from, or to the sender of a
+//   private message
+func (ctx *Context) Reply(text string) {
+	ctx.Transport.SendTo(ctx.Channel, text)
+}
+
+// Reply to the sender in a private message
+func (ctx *Context) ReplyPrivate(text string) {
+	ctx.Transport.SendPrivate(ctx.Sender, text)
+}
+
+// Reply with an action, e.g. "/me waves"
+func (ctx *Context) Action(text string) {
+	ctx.Transport.SendAction(ctx.Channel, text)
+}
+
+// Returns the text after our nick if text starts with it, e.g. "gomr: rank",
+//   "gomr, rank" or "gomr rank"
+func addressedTo(text, nick string) (string, bool) {
+	rgx := regexp.MustCompile(`(?i)^` + regexp.QuoteMeta(nick) + `[:,.]*\s+(.*)$`)
+	match := rgx.FindStringSubmatch(text)
+	if match == nil {
+		return "", false
+	}
+	return strings.TrimSpace(match[1]), true
+}
@@ -3,17 +3,23 @@ package gomr
 import (
 	"encoding/json"
 	"errors"
-	"regexp"
+
+	"github.com/go-gorp/gorp"
 )
 
 // This plugin requires a wordnik api key to be defined in configuration
 //  Get an api key here: http://developer.wordnik.com/
 
 type DictionaryPlugin struct {
-	Nick          string
 	WordnikAPIKey string
 }
 
+func init() {
+	RegisterPlugin("dictionary", func(config *Config, db *gorp.DbMap) Plugin {
+		return DictionaryPlugin{WordnikAPIKey: config.WordnikAPIKey}
+	})
+}
+
 // Struct for json response from api when getting a word definition list
 type DefineResp struct {
 	PartOfSpeech string `json:"partOfSpeech"`
@@ -28,42 +34,44 @@ func (dp DictionaryPlugin) Register() (err error) {
 	return nil
 }
 
-func (dp DictionaryPlugin) Parse(user, channel, input string, conn *Connection) (err error) {
-	if Match(input, `(?i)`+dp.Nick+`[\S]* define[:]*\s+[\S]{2,}`) {
-		wrgx, _ := regexp.Compile(`define[:]*\s+([\S]{2,})`)
-		wordMatch := wrgx.FindStringSubmatch(input)
-
-		if wordMatch != nil && len(wordMatch) > 1 {
-			word := wordMatch[1]
-			url := "http://api.wordnik.com:80/v4/word.json/" + word +
-				"/definitions?limit=1&includeRelated=false&useCanonical=true&includeTags=false&api_key=" +
-				dp.WordnikAPIKey
+// Everything is done by the define command
+func (dp DictionaryPlugin) Parse(ctx *Context) (bool, error) {
+	return false, nil
+}
 
-			var r []byte
-			r, err = HttpGet(url)
-			if err != nil {
-				err = errors.New("ERROR unable to get " + url + " : " + err.Error())
-				return
-			}
-			resp := []DefineResp{}
-			json.Unmarshal(r, &resp)
-			if len(resp) == 0 {
-				conn.SendTo(channel, "No definition found for "+word+".")
-				return
-			}
-			definition := resp[0].Text
-			conn.SendTo(channel, word+": "+definition)
-		} else {
-			err = errors.New("Dictionary Error: unable to get word definition string from input:" + input)
-			return
-		}
+func (dp DictionaryPlugin) Commands() []Command {
+	return []Command{
+		{Name: "define", Args: "<word>", Help: "Look up the definition of a word", Run: dp.define},
+	}
+}
 
+func (dp DictionaryPlugin) define(ctx *Context, args []string) (err error) {
+	word := args[0]
+	if len(word) < 2 {
+		ctx.Reply("Words to define must be at least two letters long.")
+		return nil
 	}
+	url := "http://api.wordnik.com:80/v4/word.json/" + word +
+		"/definitions?limit=1&includeRelated=false&useCanonical=true&includeTags=false&api_key=" +
+		dp.WordnikAPIKey
 
+	var r []byte
+	r, err = HttpGetContext(ctx, url)
+	if err != nil {
+		err = errors.New("ERROR unable to get " + url + " : " + err.Error())
+		return
+	}
+	resp := []DefineResp{}
+	json.Unmarshal(r, &resp)
+	if len(resp) == 0 {
+		ctx.Reply("No definition found for " + word + ".")
+		return
+	}
+	definition := resp[0].Text
+	ctx.Reply(word + ": " + definition)
 	return
 }
 
 func (dp DictionaryPlugin) Help() (texts []string) {
-	texts = append(texts, dp.Nick+"[:] define[:] <word>")
-	return texts
+	return nil
 }
@@ -0,0 +1,172 @@
+package gomr
+
+import (
+	"context"
+	"hash/fnv"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Defaults for how many messages are handled at once, and how long a plugin
+//   has to handle one
+const (
+	defaultWorkers       = 4
+	defaultPluginTimeout = 30 * time.Second
+
+	// Messages waiting for each worker before new ones are dropped
+	dispatchQueueLength = 100
+
+	// Calls to a plugin that may still be running after running out of time
+	//   before the plugin is skipped, until some of them finish
+	maxTimedOutCalls = 4
+)
+
+// dispatcher hands messages to plugins off the read loop, so a slow plugin
+//   can't hold up our PONGs or the tracking of channels and nicks. Messages
+//   are spread over the workers by where they were sent, so messages in a
+//   channel are still handled in order, and a slow plugin only holds up the
+//   channels sharing its worker.
+type dispatcher struct {
+	queues []chan *Message
+}
+
+// Start workers goroutines calling handle, see Config.Workers
+func newDispatcher(workers int, handle func(*Message)) *dispatcher {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	d := &dispatcher{queues: make([]chan *Message, workers)}
+	for i := range d.queues {
+		queue := make(chan *Message, dispatchQueueLength)
+		d.queues[i] = queue
+		go func() {
+			for msg := range queue {
+				handle(msg)
+			}
+		}()
+	}
+	return d
+}
+
+// Queue msg for the worker handling key, usually the channel it was sent to.
+//   Returns false if the worker is too far behind and msg was dropped.
+func (d *dispatcher) dispatch(key string, msg *Message) bool {
+	h := fnv.New32a()
+	h.Write([]byte(CanonicalizeIrcNick(key)))
+	select {
+	case d.queues[h.Sum32()%uint32(len(d.queues))] <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop the workers once they have handled the messages already queued. It
+//   doesn't wait for them, replies to a closed connection are dropped anyway.
+func (d *dispatcher) stop() {
+	for _, queue := range d.queues {
+		close(queue)
+	}
+}
+
+// timedOutCalls counts the calls to each plugin that ran out of time but
+//   haven't returned yet
+type timedOutCalls struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (t *timedOutCalls) add(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.calls == nil {
+		t.calls = make(map[string]int)
+	}
+	t.calls[name]++
+}
+
+func (t *timedOutCalls) done(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.calls[name]--
+}
+
+func (t *timedOutCalls) count(name string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.calls[name]
+}
+
+// The progress of a call to a plugin, see runPlugin()
+const (
+	callRunning int32 = iota
+	callFinished
+	callAbandoned
+)
+
+// Run parse, a plugin's Parse() or a command, with a deadline of
+//   Config.PluginTimeout. Returns whether the message was handled.
+//   Panics are logged and count as not handling the message. A plugin that
+//   runs out of time is left to finish in the background, and counts as not
+//   handling it, so the plugins after it still get the message. Plugins with
+//   maxTimedOutCalls calls still running are skipped until some finish.
+func (s *GomrService) runPlugin(name string, ctx *Context, parse func(*Context) (bool, error)) bool {
+	timeout := time.Duration(s.config().PluginTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultPluginTimeout
+	}
+	if n := s.timedOut.count(name); n >= maxTimedOutCalls {
+		glog.Infof("WARNING: Skipping plugin %s, %d calls to it are still running after running out of time", name, n)
+		return false
+	}
+
+	// Each plugin gets its own deadline
+	pctx := *ctx
+	var cancel context.CancelFunc
+	pctx.Context, cancel = context.WithTimeout(ctx.Context, timeout)
+	defer cancel()
+
+	type result struct {
+		handled bool
+		err     error
+	}
+	done := make(chan result, 1)
+	state := callRunning
+	go func() {
+		defer func() {
+			if !atomic.CompareAndSwapInt32(&state, callRunning, callFinished) {
+				s.timedOut.done(name)
+			}
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				glog.Infof("ERROR: Plugin %s panicked: %v\n%s", name, r, debug.Stack())
+				done <- result{}
+			}
+		}()
+		handled, err := parse(&pctx)
+		done <- result{handled, err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-pctx.Done():
+		s.timedOut.add(name)
+		if atomic.CompareAndSwapInt32(&state, callRunning, callAbandoned) {
+			glog.Infof("WARNING: Plugin %s is still running after %s, moving on without it", name, timeout)
+			return false
+		}
+		// It finished just in time
+		s.timedOut.done(name)
+		r = <-done
+	}
+	if r.err != nil {
+		glog.Infoln("ERROR in plugin", name, ":", r.err)
+	}
+	return r.handled
+}
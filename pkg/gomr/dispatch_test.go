@@ -0,0 +1,105 @@
+package gomr
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatcherOrder(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	var wg sync.WaitGroup
+	d := newDispatcher(3, func(msg *Message) {
+		mu.Lock()
+		got = append(got, msg.Trailing())
+		mu.Unlock()
+		wg.Done()
+	})
+	defer d.stop()
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		msg := &Message{Command: "PRIVMSG", Params: []string{"#test", string(rune('0' + i))}}
+		if !d.dispatch("#TEST", msg) {
+			t.Fatal("Message dropped with room in the queue")
+		}
+	}
+	wg.Wait()
+	for i := range got {
+		if got[i] != string(rune('0'+i)) {
+			t.Fatalf("Messages to one channel were handled out of order: %q", got)
+		}
+	}
+}
+
+func TestRunPlugin(t *testing.T) {
+	s := &GomrService{Config: &Config{PluginTimeout: 1}}
+	msg, _ := ParseMessage(":tim!~tim@example.com PRIVMSG #test :hi")
+	ctx := NewContext(msg, &Console{BotNick: "gomr"}, s.Config)
+
+	handled := s.runPlugin("ok", ctx, func(ctx *Context) (bool, error) { return true, nil })
+	if !handled {
+		t.Error("A plugin handling the message didn't count as handling it")
+	}
+	handled = s.runPlugin("panic", ctx, func(ctx *Context) (bool, error) { panic("boom") })
+	if handled {
+		t.Error("A plugin that panicked counted as handling the message")
+	}
+}
+
+func TestRunPluginTimeout(t *testing.T) {
+	s := &GomrService{Config: &Config{PluginTimeout: 1}}
+	msg, _ := ParseMessage(":tim!~tim@example.com PRIVMSG #test :hi")
+	ctx := NewContext(msg, &Console{BotNick: "gomr"}, s.Config)
+
+	// A plugin that ignores its deadline until released
+	release := make(chan struct{})
+	var calls sync.WaitGroup
+	stuck := func(ctx *Context) (bool, error) {
+		defer calls.Done()
+		<-release
+		return true, nil
+	}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < maxTimedOutCalls; i++ {
+		wg.Add(1)
+		calls.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.runPlugin("stuck", ctx, stuck) {
+				t.Error("A plugin that ran out of time counted as handling the message")
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 3*time.Second {
+		t.Errorf("Plugins ran out of time after %s, want 1s", elapsed)
+	}
+
+	// Too many calls are still running, so the plugin is skipped
+	skipped := true
+	s.runPlugin("stuck", ctx, func(ctx *Context) (bool, error) {
+		skipped = false
+		return true, nil
+	})
+	if !skipped {
+		t.Error("A plugin with too many calls still running wasn't skipped")
+	}
+	if !s.runPlugin("other", ctx, func(ctx *Context) (bool, error) { return true, nil }) {
+		t.Error("Other plugins were skipped too")
+	}
+
+	// Once they finish it is called again
+	close(release)
+	calls.Wait()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.timedOut.count("stuck") > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !s.runPlugin("stuck", ctx, func(ctx *Context) (bool, error) { return true, nil }) {
+		t.Error("The plugin is still skipped after its calls finished")
+	}
+}
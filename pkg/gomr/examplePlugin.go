@@ -2,11 +2,22 @@ package gomr
 
 import (
 	"errors"
+
+	"github.com/go-gorp/gorp"
 )
 
 type ExamplePlugin struct {
 }
 
+// Plugins make themselves available by registering a function that builds
+//   them, under the name used to enable them in the configuration (see
+//   PluginName()). The function is given the configuration and database.
+func init() {
+	RegisterPlugin("example", func(config *Config, db *gorp.DbMap) Plugin {
+		return ExamplePlugin{}
+	})
+}
+
 // If a table in the database is needed, a table should be defined here with a struct.
 //   The table must then be added to the database in gorp.go
 
@@ -17,29 +28,61 @@ func (e ExamplePlugin) Register() (err error) {
 	return nil
 }
 
-// Parse() is the main function of a plugin. A string from the irc channel
+// Parse() is the main function of a plugin. Every message from the irc server
 //   will be provided as an argument, for the plugin to parse as it wishes.
-// This should return a string that the bot should return.
-func (e ExamplePlugin) Parse(user, channel, input string, conn *Connection) (err error) {
+//   See context.go for what is known about the message and how to reply to
+//   it, and message.go for the fields available on the message itself.
+// This should return true if the plugin handled the message, so the plugins
+//   after it don't see it, and an error if something went wrong.
+func (e ExamplePlugin) Parse(ctx *Context) (handled bool, err error) {
+	// Most plugins only care about messages sent to a channel or to the bot
+	if ctx.Command != "PRIVMSG" {
+		return false, nil
+	}
 
 	// Check out the utils.go file for ease-of-use functions like Match()
 	// For golang-specific regex help, see: https://github.com/google/re2/wiki/Syntax
-	if Match(input, "(?i)^hello\\?") {
-		conn.SendTo(channel, "Hello "+user+"!")
+	if Match(ctx.Trailing(), "(?i)^hello\\?") {
+		ctx.Reply("Hello " + ctx.Sender + "!")
+		return true, nil
 	}
 
 	// What if an error occurs?
 	// use the errors package to create a new error and return it:
-	if Match(input, "^test error") {
-		return errors.New("This is an example error that will be logged!")
+	if Match(ctx.Trailing(), "^test error") {
+		return true, errors.New("This is an example error that will be logged!")
 		// If additional logging is necessary, you can import the "log" class and log yourself
 	}
 
 	return
 }
 
+// Priority() is optional, plugins with a higher priority are offered messages
+//   first. This one goes last, so a factoid named "hello" wins over it.
+func (e ExamplePlugin) Priority() int {
+	return -10
+}
+
+// Commands() is optional, it returns the commands the plugin answers when
+//   addressed, e.g. "gomr: wave tim" or "!wave tim". Commands are listed in
+//   help automatically, see router.go.
+func (e ExamplePlugin) Commands() []Command {
+	return []Command{
+		{Name: "wave", Args: "[nick]", Help: "Wave at someone, or whoever asked", Run: e.wave},
+	}
+}
+
+func (e ExamplePlugin) wave(ctx *Context, args []string) error {
+	nick := args[0]
+	if nick == "" {
+		nick = ctx.Sender
+	}
+	ctx.Action("waves at " + nick)
+	return nil
+}
+
 // Help should return a slice of strings, each will be sent to the user requesting help
-//  on seperate lines.
+//  on seperate lines. Commands don't need to be included.
 func (e ExamplePlugin) Help() (texts []string) {
 	texts = append(texts, "Example help text!")
 	return texts
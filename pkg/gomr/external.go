@@ -0,0 +1,443 @@
+package gomr
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/go-gorp/gorp"
+	"github.com/golang/glog"
+)
+
+// How long an external plugin has to answer hello when started, and how long
+//   to wait between restarts after it exits, see Backoff
+const (
+	externalStartTimeout    = 10 * time.Second
+	externalRestartMinDelay = time.Second
+	externalRestartMaxDelay = 5 * time.Minute
+
+	// A process that stays up this long resets the restart backoff when it exits
+	externalStableTime = time.Minute
+
+	// Actions waiting to be carried out before more are ignored
+	externalMaxActions = 100
+
+	// The longest line a plugin may send, a longer one gets it restarted
+	externalMaxLineLength = 1024 * 1024
+)
+
+// ExternalPlugin runs a plugin written in any language as a separate
+//   process, see ExternalPluginConfig. Gomr writes events to its stdin and
+//   reads actions from its stdout, one JSON object per line. Its stderr is
+//   logged. The process is restarted if it exits.
+//
+// Once started, it is sent:
+//   {"event": "hello", "api": 1, "name": "weather"}
+// and must answer with its help lines and priority (see Prioritizer):
+//   {"action": "hello", "help": ["weather? - Today's weather"], "priority": 0}
+//
+// Each PRIVMSG is then sent as (see Context for the fields):
+//   {"event": "message", "me": "gomr", "nick": "tim", "account": "tim",
+//    "channel": "#gomr", "text": "gomr: weather?", "stripped": "weather?",
+//    "addressed": true, "private": false, "namespace": ""}
+// and the plugin answers with any number of actions, ending with done:
+//   {"action": "reply", "text": "Sunny"}     Reply in the channel
+//   {"action": "private", "text": "Sunny"}   Reply by private message
+//   {"action": "me", "text": "looks up"}     Reply with an action
+//   {"action": "store", "name": "k", "value": "v"}  Remember a value in the
+//                                            namespace, empty forgets it
+//   {"action": "fetch", "name": "k"}         Gomr answers with
+//     {"event": "value", "name": "k", "value": "v", "found": true}
+//   {"action": "done", "handled": true}      See Plugin.Parse()
+//
+// A plugin that doesn't answer in time (see Config.PluginTimeout) is
+//   restarted.
+type ExternalPlugin struct {
+	Config ExternalPluginConfig
+	Db     *gorp.DbMap
+
+	mu       sync.Mutex // Held while a message is handled, one at a time
+	proc     *externalProc
+	help     []string
+	priority int
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// A value stored by an external plugin
+type PluginData struct {
+	Id        int    `db:"id, primarykey, autoincrement"`
+	Plugin    string `db:"plugin, size:100"`
+	Name      string `db:"name, size:100"`
+	Value     string `db:"value, size:1000"`
+	Namespace string `db:"namespace, size:100"`
+}
+
+// Lines sent to and received from the process
+type externalEvent struct {
+	Event string `json:"event"`
+	API   int    `json:"api,omitempty"`
+	Name  string `json:"name,omitempty"`
+
+	Me        string `json:"me,omitempty"`
+	Nick      string `json:"nick,omitempty"`
+	Account   string `json:"account,omitempty"`
+	Channel   string `json:"channel,omitempty"`
+	Text      string `json:"text,omitempty"`
+	Stripped  string `json:"stripped,omitempty"`
+	Addressed bool   `json:"addressed"`
+	Private   bool   `json:"private"`
+	Namespace string `json:"namespace"`
+
+	Value string `json:"value,omitempty"`
+	Found bool   `json:"found,omitempty"`
+}
+
+type externalAction struct {
+	Action   string   `json:"action"`
+	Text     string   `json:"text"`
+	Name     string   `json:"name"`
+	Value    string   `json:"value"`
+	Handled  bool     `json:"handled"`
+	Help     []string `json:"help"`
+	Priority int      `json:"priority"`
+}
+
+// A running plugin process
+type externalProc struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	actions chan externalAction // Closed once the process closes its stdout
+	exited  chan struct{}       // Closed once the process has exited
+}
+
+func NewExternalPlugin(config ExternalPluginConfig, db *gorp.DbMap) *ExternalPlugin {
+	return &ExternalPlugin{
+		Config: config,
+		Db:     db,
+		stop:   make(chan struct{}),
+	}
+}
+
+// The name is configured, rather than taken from the type
+func (p *ExternalPlugin) PluginName() string {
+	return p.Config.Name
+}
+
+// Start the process, it is restarted from then on until Close()
+func (p *ExternalPlugin) Register() error {
+	proc, err := p.start()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.proc = proc
+	p.mu.Unlock()
+
+	go p.supervise(proc)
+	return nil
+}
+
+// Stop the process, and stop restarting it
+func (p *ExternalPlugin) Close() error {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+	return nil
+}
+
+func (p *ExternalPlugin) Priority() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.priority
+}
+
+func (p *ExternalPlugin) Help() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.help
+}
+
+// Send the message to the process and carry out the actions it answers with
+func (p *ExternalPlugin) Parse(ctx *Context) (bool, error) {
+	if ctx.Command != "PRIVMSG" {
+		return false, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Messages are missed while the process is being restarted
+	proc := p.proc
+	if proc == nil {
+		return false, nil
+	}
+	proc.discard()
+
+	err := proc.send(ctx.Done(), externalEvent{
+		Event:     "message",
+		Me:        ctx.Transport.Nick(),
+		Nick:      ctx.Sender,
+		Account:   ctx.Account,
+		Channel:   ctx.Channel,
+		Text:      ctx.Trailing(),
+		Stripped:  ctx.Stripped,
+		Addressed: ctx.Addressed,
+		Private:   ctx.Private,
+		Namespace: ctx.Namespace,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for {
+		select {
+		case action, ok := <-proc.actions:
+			if !ok {
+				return false, errors.New("The plugin exited while handling a message")
+			}
+			switch action.Action {
+			case "reply":
+				ctx.Reply(action.Text)
+			case "private":
+				ctx.ReplyPrivate(action.Text)
+			case "me":
+				ctx.Action(action.Text)
+			case "store":
+				if err := p.store(action.Name, action.Value, ctx.Namespace); err != nil {
+					glog.Infof("ERROR: Unable to store %s for plugin %s: %s", action.Name, p.Config.Name, err)
+				}
+			case "fetch":
+				value, err := p.fetch(action.Name, ctx.Namespace)
+				if err != nil && err != sql.ErrNoRows {
+					glog.Infof("ERROR: Unable to fetch %s for plugin %s: %s", action.Name, p.Config.Name, err)
+				}
+				found := err == nil
+				err = proc.send(ctx.Done(), externalEvent{Event: "value", Name: action.Name, Value: value, Found: found, Namespace: ctx.Namespace})
+				if err != nil {
+					return false, err
+				}
+			case "done":
+				return action.Handled, nil
+			default:
+				glog.Infof("WARNING: Plugin %s sent unknown action %q", p.Config.Name, action.Action)
+			}
+		case <-ctx.Done():
+			// It would answer this message when asked about the next one
+			proc.kill()
+			return false, errors.New("The plugin took too long to answer, restarting it")
+		}
+	}
+}
+
+// Start the process and wait for it to say hello
+func (p *ExternalPlugin) start() (*externalProc, error) {
+	cmd := exec.Command(p.Config.Command, p.Config.Args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	proc := &externalProc{
+		cmd:     cmd,
+		stdin:   stdin,
+		actions: make(chan externalAction, externalMaxActions),
+		exited:  make(chan struct{}),
+	}
+
+	// Wait() may only be called once both pipes have been read to the end
+	var reading sync.WaitGroup
+	reading.Add(2)
+	go func() {
+		defer reading.Done()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			glog.Infof("Plugin %s: %s", p.Config.Name, scanner.Text())
+		}
+	}()
+	go func() {
+		defer reading.Done()
+		defer close(proc.actions)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(nil, externalMaxLineLength)
+		for scanner.Scan() {
+			var action externalAction
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				glog.Infof("WARNING: Plugin %s sent a line that isn't JSON: %s", p.Config.Name, sanitizeText(scanner.Text()))
+				continue
+			}
+			select {
+			case proc.actions <- action:
+			default:
+				glog.Infof("WARNING: Plugin %s sent too many actions, ignoring: %s", p.Config.Name, sanitizeText(scanner.Text()))
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			// Nothing more can be read, so it has to start over. Whatever it
+			//   (or a child still holding its stdout) writes until then is
+			//   thrown away, so it isn't left blocked on a full pipe.
+			glog.Infof("ERROR: Unable to read from plugin %s, restarting it: %s", p.Config.Name, err)
+			proc.kill()
+			io.Copy(ioutil.Discard, stdout)
+		}
+	}()
+	go func() {
+		reading.Wait()
+		cmd.Wait()
+		close(proc.exited)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), externalStartTimeout)
+	defer cancel()
+	if err := proc.send(ctx.Done(), externalEvent{Event: "hello", API: PluginAPIVersion, Name: p.Config.Name}); err != nil {
+		proc.kill()
+		return nil, err
+	}
+	select {
+	case action, ok := <-proc.actions:
+		if !ok || action.Action != "hello" {
+			proc.kill()
+			return nil, errors.New("The plugin didn't answer hello")
+		}
+		p.mu.Lock()
+		p.help, p.priority = action.Help, action.Priority
+		p.mu.Unlock()
+	case <-ctx.Done():
+		proc.kill()
+		return nil, errors.New("The plugin didn't answer hello in " + externalStartTimeout.String())
+	}
+	return proc, nil
+}
+
+// Restart the process whenever it exits, until Close()
+func (p *ExternalPlugin) supervise(proc *externalProc) {
+	backoff := Backoff{Min: externalRestartMinDelay, Max: externalRestartMaxDelay}
+	for {
+		started := time.Now()
+		select {
+		case <-proc.exited:
+		case <-p.stop:
+			p.mu.Lock()
+			p.proc = nil
+			p.mu.Unlock()
+			proc.kill()
+			return
+		}
+		glog.Infof("ERROR: Plugin %s exited: %v", p.Config.Name, proc.cmd.ProcessState)
+		p.mu.Lock()
+		p.proc = nil
+		p.mu.Unlock()
+		if time.Since(started) > externalStableTime {
+			backoff.Reset()
+		}
+
+		for proc = nil; proc == nil; {
+			delay := backoff.Next()
+			glog.Infof("Restarting plugin %s in %s (attempt %d)", p.Config.Name, delay, backoff.Attempts())
+			select {
+			case <-time.After(delay):
+			case <-p.stop:
+				return
+			}
+
+			var err error
+			proc, err = p.start()
+			if err != nil {
+				glog.Infof("ERROR: Unable to restart plugin %s: %s", p.Config.Name, err)
+			}
+		}
+		p.mu.Lock()
+		p.proc = proc
+		p.mu.Unlock()
+	}
+}
+
+// Write an event to the process. If done is closed before the process has
+//   read it, e.g. because it stopped reading and the pipe is full, the
+//   process is killed.
+func (proc *externalProc) send(done <-chan struct{}, event externalEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := proc.stdin.Write(append(line, '\n'))
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		return err
+	case <-done:
+		// Closing stdin ends the write
+		proc.kill()
+		return errors.New("The plugin stopped reading messages, restarting it")
+	}
+}
+
+// Throw away actions sent while no message was being handled
+func (proc *externalProc) discard() {
+	for {
+		select {
+		case action, ok := <-proc.actions:
+			if !ok {
+				return
+			}
+			glog.Infof("WARNING: Ignoring %q action sent while no message was being handled", action.Action)
+		default:
+			return
+		}
+	}
+}
+
+// The supervisor notices and restarts the process
+func (proc *externalProc) kill() {
+	proc.stdin.Close()
+	proc.cmd.Process.Kill()
+}
+
+// Remember a value for the plugin, an empty value forgets it
+func (p *ExternalPlugin) store(name, value, namespace string) error {
+	var data PluginData
+	err := p.Db.SelectOne(&data, "select * from plugin_data where plugin=? and name=? and namespace=?", p.Config.Name, name, namespace)
+	switch {
+	case err == sql.ErrNoRows && value == "":
+		return nil
+	case err == sql.ErrNoRows:
+		data = PluginData{Plugin: p.Config.Name, Name: name, Value: value, Namespace: namespace}
+		return p.Db.Insert(&data)
+	case err != nil:
+		return err
+	case value == "":
+		_, err = p.Db.Delete(&data)
+		return err
+	}
+	data.Value = value
+	_, err = p.Db.Update(&data)
+	return err
+}
+
+func (p *ExternalPlugin) fetch(name, namespace string) (string, error) {
+	var data PluginData
+	err := p.Db.SelectOne(&data, "select * from plugin_data where plugin=? and name=? and namespace=?", p.Config.Name, name, namespace)
+	return data.Value, err
+}
@@ -0,0 +1,88 @@
+package gomr
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A plugin that stops reading its input must not hang Parse() for good
+func TestExternalPluginStopsReading(t *testing.T) {
+	p := NewExternalPlugin(ExternalPluginConfig{
+		Name:    "stuck",
+		Command: "sh",
+		Args:    []string{"-c", `read hello; echo '{"action": "hello"}'; exec sleep 60`},
+	}, nil)
+	if err := p.Register(); err != nil {
+		t.Fatal("Unable to start the plugin:", err)
+	}
+	defer p.Close()
+
+	// More than fits in the pipe to the process
+	msg, _ := ParseMessage(":tim!~tim@example.com PRIVMSG #test :" + strings.Repeat("a", 1<<20))
+	ctx := NewContext(msg, &Console{BotNick: "gomr"}, &Config{})
+	var cancel context.CancelFunc
+	ctx.Context, cancel = context.WithTimeout(ctx.Context, 100*time.Millisecond)
+	defer cancel()
+
+	parsed := make(chan error, 1)
+	go func() {
+		_, err := p.Parse(ctx)
+		parsed <- err
+	}()
+	select {
+	case err := <-parsed:
+		if err == nil {
+			t.Error("Parse() returned no error for a plugin that stopped reading")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Parse() is still writing to a plugin that stopped reading")
+	}
+}
+
+// A plugin that sends a line too long to read is restarted
+func TestExternalPluginLongLine(t *testing.T) {
+	script := `
+read hello
+echo '{"action": "hello"}'
+while read message; do
+	if [ -e "$1" ]; then
+		echo '{"action": "done", "handled": true}'
+	else
+		touch "$1"
+		head -c 2000000 /dev/zero | tr '\0' a
+		echo
+	fi
+done`
+	p := NewExternalPlugin(ExternalPluginConfig{
+		Name:    "long",
+		Command: "sh",
+		Args:    []string{"-c", script, "sh", t.TempDir() + "/sent"},
+	}, nil)
+	if err := p.Register(); err != nil {
+		t.Fatal("Unable to start the plugin:", err)
+	}
+	defer p.Close()
+
+	msg, _ := ParseMessage(":tim!~tim@example.com PRIVMSG #test :hi")
+	parse := func() (bool, error) {
+		ctx := NewContext(msg, &Console{BotNick: "gomr"}, &Config{})
+		var cancel context.CancelFunc
+		ctx.Context, cancel = context.WithTimeout(ctx.Context, time.Second)
+		defer cancel()
+		return p.Parse(ctx)
+	}
+
+	if _, err := parse(); err == nil {
+		t.Error("Parse() returned no error when the plugin's answer couldn't be read")
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if handled, _ := parse(); handled {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("The plugin was never restarted")
+}
@@ -2,7 +2,6 @@ package gomr
 
 import (
 	"database/sql"
-	"errors"
 	"regexp"
 	"strconv"
 	"time"
@@ -14,7 +13,24 @@ type FactoidPlugin struct {
 	// The plugin will silently ignore the following words
 	Blacklist []string
 	Db        *gorp.DbMap
-	Nick      string
+	Nick      string // Shown in help
+}
+
+// Words that aren't facts unless Config.FactoidBlacklist says otherwise
+var defaultFactoidBlacklist = []string{"why", "where", "who", "when", "how", "now"}
+
+func init() {
+	RegisterPlugin("factoid", func(config *Config, db *gorp.DbMap) Plugin {
+		blacklist := config.FactoidBlacklist
+		if len(blacklist) == 0 {
+			blacklist = defaultFactoidBlacklist
+		}
+		return FactoidPlugin{
+			Blacklist: blacklist,
+			Db:        db,
+			Nick:      config.Nick,
+		}
+	})
 }
 
 type Factoid struct {
@@ -22,54 +38,67 @@ type Factoid struct {
 	Fact         string `db:"fact, size:100"`
 	Definition   string `db:"definition, size:1000"`
 	CreationDate int64  `db:"creation_date"`
+	Namespace    string `db:"namespace, size:100"`
 }
 
 func (fp FactoidPlugin) Register() (err error) {
 	return nil
 }
 
-func (fp FactoidPlugin) Parse(sender, channel, input string, conn *Connection) (err error) {
+// Factoids go first, a definition may contain anything, e.g. "bar++"
+func (fp FactoidPlugin) Priority() int {
+	return 20
+}
+
+func (fp FactoidPlugin) Parse(ctx *Context) (handled bool, err error) {
+	if ctx.Command != "PRIVMSG" {
+		return false, nil
+	}
+	// Factoids may be asked for without addressing us, e.g. "gomr?" or
+	//   "what is gomr?", but only set or forgotten when addressed.
+	input := ctx.Stripped
+	namespace := ctx.Namespace
+
 	// Check for factoid retrieval match
-	if Match(input, `^\S+\?\r$`) ||
-		Match(input, `(?i)^`+fp.Nick+`:*\s+\S+\?\r$`) ||
-		Match(input, `(?i)^(`+fp.Nick+`:*\s)?\s*what\s*is\s+\S+\??\r$`) {
-		frgxStr := `(?i)^(?:` + fp.Nick + `:*\s)?\s*(?:what\s*is\s+)?(\S+?)\??\r$`
-		frgx := regexp.MustCompile(frgxStr)
+	if Match(input, `^\S+\?$`) || Match(input, `(?i)^what\s*is\s+\S+\??$`) {
+		frgx := regexp.MustCompile(`(?i)^(?:what\s*is\s+)?(\S+?)\??$`)
 		fmatch := frgx.FindStringSubmatch(input)
 
 		if fmatch != nil && len(fmatch) > 1 {
-			if len(fmatch) > 2 {
-				return errors.New("Found more than one match for factoid, stopping processing.")
-			}
 			fact := fmatch[1]
 
 			// Loop through the blacklist and end it if a match is found
 			for _, blWord := range fp.Blacklist {
 				if fact == blWord {
-					return nil
+					return false, nil
 				}
 			}
 
 			var factoids []Factoid
-			factoids, err = fp.GetFactoids(fact)
+			factoids, err = fp.GetFactoids(fact, namespace)
 			if err != nil {
-				return err
+				return false, err
 			}
 
 			if len(factoids) > 1 {
 				for i := range factoids {
-					conn.SendTo(channel, "#"+strconv.Itoa(i+1)+" "+fact+": "+factoids[i].Definition)
+					ctx.Reply("#" + strconv.Itoa(i+1) + " " + fact + ": " + factoids[i].Definition)
 				}
 			} else if len(factoids) > 0 {
-				conn.SendTo(channel, fact+" is "+factoids[0].Definition)
+				ctx.Reply(fact + " is " + factoids[0].Definition)
 			}
 
-			return nil
+			// Unknown facts are left to other plugins, e.g. "hello?"
+			return len(factoids) > 0, nil
 		}
 	}
 
+	if !ctx.Addressed {
+		return false, nil
+	}
+
 	// Check for factoid set match
-	setrgxStr := `(?i)^` + fp.Nick + `:*\s+(\S+) is\s+(\S+.*)\r$`
+	setrgxStr := `(?i)^(\S+) is\s+(\S+.*)$`
 	if Match(input, setrgxStr) {
 		srgx := regexp.MustCompile(setrgxStr)
 		smatch := srgx.FindStringSubmatch(input)
@@ -80,73 +109,64 @@ func (fp FactoidPlugin) Parse(sender, channel, input string, conn *Connection) (
 			// Loop through the blacklist and end it if a match is found
 			for _, blWord := range fp.Blacklist {
 				if fact == blWord {
-					return nil
+					return false, nil
 				}
 			}
 
 			utime := time.Now().Unix()
-			factoid := Factoid{Fact: fact, Definition: def, CreationDate: utime}
+			factoid := Factoid{Fact: fact, Definition: def, CreationDate: utime, Namespace: namespace}
 			err = fp.Create(factoid)
 			if err != nil {
-				return err
+				return true, err
 			}
-			conn.SendTo(channel, "Ok, I'll remember "+fact)
-			return nil
+			ctx.Reply("Ok, I'll remember " + fact)
+			return true, nil
 		}
 	}
 
-	// Check for factoid forget match
-	frgxStr := `(?i)^` + fp.Nick + `:*\s+forget\s+(\S+)\s*([0-9]*)\r$`
-	if Match(input, frgxStr) {
-		frgx := regexp.MustCompile(frgxStr)
-		fmatch := frgx.FindStringSubmatch(input)
-		if fmatch != nil && len(fmatch) > 1 {
-			if fmatch[2] != "" {
-				// id was provided
-				id, _ := strconv.Atoi(fmatch[2])
-				fact := fmatch[1]
-				factoids, err := fp.GetFactoids(fact)
-				if err != nil {
-					return err
-				}
-
-				if len(factoids) == 0 {
-					conn.SendTo(channel, fact+" has never been defined.")
-					return nil
-				}
+	return false, nil
+}
 
-				if len(factoids) < id {
-					conn.SendTo(channel, "No definition for "+fact+" exists with ID: "+strconv.Itoa(id))
-					return nil
-				}
+func (fp FactoidPlugin) Commands() []Command {
+	return []Command{
+		{Name: "forget", Args: "<fact> [n]", Help: "Forget the latest definition of a fact, or the nth one", Run: fp.forget},
+	}
+}
 
-				err = fp.Delete(factoids[id-1])
-				if err != nil {
-					return err
-				}
+func (fp FactoidPlugin) forget(ctx *Context, args []string) error {
+	fact := args[0]
+	factoids, err := fp.GetFactoids(fact, ctx.Namespace)
+	if err != nil {
+		return err
+	}
 
-				conn.SendTo(channel, "Deleted definition for "+fact+" with ID: "+strconv.Itoa(id))
-			} else {
-				// id not provided - delete the latest
-				fact := fmatch[1]
-				factoids, err := fp.GetFactoids(fact)
-				if err != nil {
-					return err
-				}
+	if len(factoids) == 0 {
+		ctx.Reply(fact + " has never been defined.")
+		return nil
+	}
 
-				if len(factoids) == 0 {
-					conn.SendTo(channel, fact+" has never been defined.")
-					return nil
-				}
+	if args[1] != "" {
+		// id was provided
+		id, err := strconv.Atoi(args[1])
+		if err != nil || id < 1 || len(factoids) < id {
+			ctx.Reply("No definition for " + fact + " exists with ID: " + args[1])
+			return nil
+		}
 
-				err = fp.Delete(factoids[len(factoids)-1])
-				if err != nil {
-					return err
-				}
+		err = fp.Delete(factoids[id-1])
+		if err != nil {
+			return err
+		}
 
-				conn.SendTo(channel, "Deleted latest definition of "+fact)
-			}
+		ctx.Reply("Deleted definition for " + fact + " with ID: " + strconv.Itoa(id))
+	} else {
+		// id not provided - delete the latest
+		err = fp.Delete(factoids[len(factoids)-1])
+		if err != nil {
+			return err
 		}
+
+		ctx.Reply("Deleted latest definition of " + fact)
 	}
 	return nil
 }
@@ -156,7 +176,6 @@ func (fp FactoidPlugin) Help() (texts []string) {
 	texts = append(texts, fp.Nick+"[:] <fact>?")
 	texts = append(texts, "["+fp.Nick+"[:]] what is <fact>[?]")
 	texts = append(texts, "<fact>?")
-	texts = append(texts, fp.Nick+"[:] forget <fact> [n]")
 	return texts
 }
 
@@ -186,7 +205,7 @@ func (fp FactoidPlugin) Update(f Factoid) (err error) {
 	return nil
 }
 
-func (fp FactoidPlugin) GetFactoids(fact string) (factoids []Factoid, err error) {
-	_, err = fp.Db.Select(&factoids, "select * from factoids where fact=? order by creation_date ASC", fact)
+func (fp FactoidPlugin) GetFactoids(fact, namespace string) (factoids []Factoid, err error) {
+	_, err = fp.Db.Select(&factoids, "select * from factoids where fact=? and namespace=? order by creation_date ASC", fact, namespace)
 	return
 }
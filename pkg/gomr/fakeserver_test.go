@@ -0,0 +1,88 @@
+package gomr
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeServer is an irc server on localhost for tests. Every line a client
+//   sends is passed to handle, along with a function sending a line back to
+//   that client. handle returns false to drop the client.
+type fakeServer struct {
+	listener net.Listener
+	Hostname string
+	Port     string
+
+	mu      sync.Mutex
+	clients []net.Conn
+}
+
+func newFakeServer(t *testing.T, handle func(reply func(string), line string) bool) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unable to start the fake server:", err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	s := &fakeServer{listener: listener, Hostname: host, Port: port}
+	t.Cleanup(s.Close)
+
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.clients = append(s.clients, client)
+			s.mu.Unlock()
+			go s.serve(t, client, handle)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(t *testing.T, client net.Conn, handle func(reply func(string), line string) bool) {
+	defer client.Close()
+	reply := func(line string) {
+		client.Write([]byte(line + "\r\n"))
+	}
+	r := bufio.NewReader(client)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		t.Log("Received:", line)
+		if !handle(reply, line) {
+			return
+		}
+	}
+}
+
+// Close stops listening and drops every client
+func (s *fakeServer) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, client := range s.clients {
+		client.Close()
+	}
+}
+
+// The config to connect to the fake server as gomr
+func (s *fakeServer) config() *Config {
+	return &Config{Hostname: s.Hostname, Port: s.Port, Nick: "gomr"}
+}
+
+// Accept the registration of the client that sent line, if it is a NICK
+func welcome(reply func(string), line string) {
+	if strings.HasPrefix(line, "NICK ") {
+		nick := strings.TrimPrefix(line, "NICK ")
+		reply(":irc.example.com 001 " + nick + " :Welcome to the fake network " + nick)
+		reply(":irc.example.com 376 " + nick + " :End of /MOTD command.")
+	}
+}
@@ -1,10 +1,12 @@
 package gomr
 
 import (
-	"bufio"
 	"fmt"
 	"reflect"
-	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-gorp/gorp"
 	"github.com/golang/glog"
@@ -14,44 +16,31 @@ type GomrService struct {
 	Config  *Config
 	Db      *gorp.DbMap
 	Plugins []Plugin
+	Router  *Router // Commands of gomr and its plugins, see RegisterPlugins()
+
+	// Re-reads the configuration for Reload(), if it can be reloaded
+	Reloader func() (*Config, error)
+
+	// Protects Config, Plugins and Router, which Reload() replaces while
+	//   messages are being handled, and the connection being served
+	mu   sync.RWMutex
+	conn *Connection
+
+	reloading sync.Mutex // Held by Reload(), one at a time
+
+	timedOut timedOutCalls // Plugin calls still running after their deadline, see runPlugin()
 }
 
 func NewGomrService(config *Config, dbConfig *DbConfig) (*GomrService, error) {
 	// Initiate database connection
 	glog.Infoln("Getting database connection...")
-	database, err := InitDB(dbConfig.Hostname, dbConfig.Port,
-		dbConfig.Username, dbConfig.Password, dbConfig.Name)
+	database, err := OpenDB(dbConfig)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to connect to to database:", err)
-	}
-
-	// TODO allow plugins to be configurable somehow
-	// Really I'd like to get rid of the word 'plugin' entirely since its a feature in go1.8beta now
-	// That, or actually use the plugin feature. That would be neato
-	var plugins []Plugin
-
-	ex := ExamplePlugin{}
-	plugins = append(plugins, ex)
-
-	karma := KarmaPlugin{
-		Db:   database,
-		Nick: config.Nick,
-	}
-	plugins = append(plugins, karma)
-
-	factoid := FactoidPlugin{
-		// TODO this should be configurable
-		Blacklist: []string{"why", "where", "who", "when", "how", "now"},
-		Db:        database,
-		Nick:      config.Nick,
+		return nil, fmt.Errorf("Unable to connect to the database: %s", err)
 	}
-	plugins = append(plugins, factoid)
 
-	dict := DictionaryPlugin{
-		Nick:          config.Nick,
-		WordnikAPIKey: config.WordnikAPIKey,
-	}
-	plugins = append(plugins, dict)
+	// Plugins from Config.PluginDir are already registered, see LoadPlugins()
+	plugins := buildPlugins(config, database)
 
 	service := &GomrService{
 		Config:  config,
@@ -63,131 +52,302 @@ func NewGomrService(config *Config, dbConfig *DbConfig) (*GomrService, error) {
 	return service, err
 }
 
+// How long to wait between reconnect attempts, see Backoff
+const (
+	reconnectMinDelay = 2 * time.Second
+	reconnectMaxDelay = 5 * time.Minute
+
+	// A connection that stays up this long is considered healthy, and
+	//   resets the reconnect backoff when it drops.
+	stableConnectionTime = time.Minute
+)
+
+// Run connects to the irc server and processes lines from it until the
+//   configured number of reconnect attempts is exhausted. A RegistrationError
+//   that isn't Temporary, like a wrong password or a ban, is returned
+//   straight away rather than retried.
 func (s *GomrService) Run() error {
-	// create a connection to the irc server and join channel
-	conn, err := NewConnection(s.Config.Hostname, s.Config.Port, s.Config.Channel, s.Config.Nick)
-	if err != nil {
-		return fmt.Errorf("Unable to connect to", s.Config.Hostname, ":", s.Config.Port, err)
-	}
+	backoff := Backoff{Min: reconnectMinDelay, Max: reconnectMaxDelay}
 
-	// Loop through the connection stream for the rest of forseeable time
-	stream := bufio.NewReader(conn.Conn)
 	for {
-		line, err := stream.ReadString('\n')
-		if err != nil {
-			if err.Error() == "EOF" {
-				continue
+		// The configuration may have been reloaded since the last attempt
+		config := s.config()
+		server := config.Hostname + ":" + config.Port
+
+		glog.Infoln("Connecting to", server)
+		conn, err := NewConnection(config)
+		if regErr, ok := err.(*RegistrationError); ok {
+			glog.Infoln("ERROR: The server refused our registration:", regErr)
+			if !regErr.Temporary {
+				return regErr
+			}
+		} else if err != nil {
+			glog.Infoln("ERROR: Unable to connect to", server, ":", err)
+		} else {
+			glog.Infoln("Connected to", server)
+			connected := time.Now()
+			err = s.serve(conn)
+			glog.Infoln("Disconnected from", server, ":", err)
+			if time.Since(connected) > stableConnectionTime {
+				backoff.Reset()
 			}
-			glog.Infoln("ERROR: Failed to read from input stream:", err)
-			return err // TODO eventually this should be continue, but I want errors to be very obvious for now
 		}
-		s.ParseLine(line, conn)
+
+		if config.MaxRetries > 0 && backoff.Attempts() >= config.MaxRetries {
+			return fmt.Errorf("Giving up on %s after %d reconnect attempts: %s", server, backoff.Attempts(), err)
+		}
+		delay := backoff.Next()
+		glog.Infof("Reconnecting to %s in %s (attempt %d)", server, delay, backoff.Attempts())
+		time.Sleep(delay)
 	}
+}
 
-	// Close the connection if we ever get here for some reason
-	conn.Conn.Close()
+// Loop through the connection stream until the connection is lost. Messages
+//   are handled by a pool of workers, see dispatcher
+func (s *GomrService) serve(conn *Connection) error {
+	defer conn.Close()
+	workers := newDispatcher(s.config().Workers, func(msg *Message) {
+		s.HandleMessage(msg, conn)
+	})
+	defer workers.stop()
 
-	return nil
+	// Reload() applies channel changes to the connection being served
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+	}()
+
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			// io.EOF means the server closed the connection
+			return err
+		}
+
+		// If a PING is received from the server, respond to avoid being disconnected
+		if msg.Command == "PING" {
+			respondToPing(msg, conn)
+			continue
+		}
+		if !workers.dispatch(msg.ReplyTarget(conn.Nick()), msg) {
+			glog.Infoln("WARNING: Too many messages waiting for plugins, dropping:", msg)
+		}
+	}
 }
 
-// All plugins should be registered here.
+// Register every plugin, those that fail to register are disabled
 func (s *GomrService) RegisterPlugins() error {
-	for _, p := range s.Plugins {
+	plugins := registerPlugins(s.Plugins)
+	sortPlugins(plugins, s.Config.PluginOrder)
+	router, plugins, err := s.newRouter(plugins)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.Plugins, s.Router = plugins, router
+	s.mu.Unlock()
+	return nil
+}
+
+// Returns the plugins that registered successfully
+func registerPlugins(plugins []Plugin) (registered []Plugin) {
+	for _, p := range plugins {
 		err := p.Register()
 		if err != nil {
-			return fmt.Errorf("ERROR: Unable to register and enable plugin %s: %s\n", reflect.TypeOf(p), err)
+			glog.Infof("WARNING: Unable to register plugin %s, disabling it: %s", PluginName(p), err)
+			continue
 		}
 		glog.Infof("Successfully registered plugin %s", reflect.TypeOf(p))
+		registered = append(registered, p)
 	}
-	return nil
+	return registered
+}
+
+// Build a router for gomr's own commands and those of plugins. Plugins whose
+//   commands can't be added, e.g. because another plugin already has a
+//   command of the same name, are disabled. Returns the plugins left enabled.
+func (s *GomrService) newRouter(plugins []Plugin) (*Router, []Plugin, error) {
+	router := NewRouter()
+	if err := router.Add("", s.commands()...); err != nil {
+		return nil, nil, err
+	}
+	var enabled []Plugin
+	for _, p := range plugins {
+		if c, ok := p.(Commander); ok {
+			if err := router.Add(PluginName(p), c.Commands()...); err != nil {
+				glog.Infof("WARNING: Unable to add the commands of plugin %s, disabling it: %s", PluginName(p), err)
+				closePlugins([]Plugin{p})
+				continue
+			}
+		}
+		enabled = append(enabled, p)
+	}
+	return router, enabled, nil
 }
 
-// Main method to parse lines sent from the server
-// Loops through each plugin in pluginList and runs the Parse() method from each
-//   on the provided line
-func (s *GomrService) ParseLine(line string, conn *Connection) {
-	glog.Infoln(line)
+// Order plugins as they should be offered messages: those in order (see
+//   Config.PluginOrder) first, in that order, then the rest by Priority()
+func sortPlugins(plugins []Plugin, order []string) {
+	position := make(map[string]int)
+	for i, name := range order {
+		position[strings.ToLower(name)] = i - len(order)
+	}
+	rank := func(p Plugin) (int, int) {
+		if pos, ok := position[PluginName(p)]; ok {
+			return pos, 0
+		}
+		if pr, ok := p.(Prioritizer); ok {
+			return 0, pr.Priority()
+		}
+		return 0, 0
+	}
+	sort.SliceStable(plugins, func(i, j int) bool {
+		iPos, iPriority := rank(plugins[i])
+		jPos, jPriority := rank(plugins[j])
+		if iPos != jPos {
+			return iPos < jPos
+		}
+		return iPriority > jPriority
+	})
+}
 
-	// If a PING is received from the server, respond to avoid being disconnected
-	if Match(line, "^PING :") {
-		respondToPing(line, conn)
-		return
+// Commands gomr answers itself
+func (s *GomrService) commands() []Command {
+	return []Command{
+		{Name: "help", Help: "Send this help by private message", Run: s.help},
+		{Name: "more", Help: "Continue the last message that was too long to send at once", Run: more},
+		{Name: "lag", Help: "Show how long the server takes to answer a ping", Run: lag},
+		{Name: "reload", Help: "Re-read the configuration and restart the plugins", Admin: true, Run: s.reload},
 	}
+}
 
-	// In this block, we use regex to determin the user who sent the message,
-	//   the channel the message was sent on, and the message itself.
-	// Example lines from server:
-	// 2016/02/22 13:37:58 :tim!~tim@example.com PRIVMSG #test11123 :This is a test string
-	// 2016/02/22 13:38:11 :tim!~tim@example.com NICK :timbo
-	// 2016/02/22 13:38:13 :timbo!~tim@example.com PRIVMSG #test11123 :this is another test string
-	var user, channel, msg string
-	var urgx, crgx, mrgx *regexp.Regexp
+// Send the help of every plugin enabled where it was asked for
+func (s *GomrService) help(ctx *Context, args []string) error {
+	nick := ctx.Transport.Nick()
+	config, router := s.config(), s.router()
+	for _, p := range s.enabledPlugins(ctx.Target()) {
+		for _, text := range router.Help(PluginName(p), nick) {
+			ctx.ReplyPrivate(text)
+		}
+		// For now, always send help text to the user in a private message
+		//  It is likely the help text will get too big for a channel.
+		for _, text := range p.Help() {
+			ctx.ReplyPrivate(text)
+		}
+	}
+	for _, text := range router.Help("", nick) {
+		ctx.ReplyPrivate(text)
+	}
+	ctx.ReplyPrivate("Want to contribute? Source: " + config.Source)
+	if !ctx.Private {
+		ctx.Reply(ctx.Sender + ", help information sent via private message")
+	}
+	return nil
+}
 
-	urgx = regexp.MustCompile(`:(\S+)!~`)
-	umatch := urgx.FindStringSubmatch(line)
-	if umatch != nil && len(umatch) > 1 {
-		user = umatch[1]
-		glog.Infoln("user:", user)
+func more(ctx *Context, args []string) error {
+	if !ctx.Transport.More(ctx.Channel) {
+		ctx.Reply("There is nothing more to see.")
 	}
+	return nil
+}
 
-	crgx = regexp.MustCompile(`\sPRIVMSG\s(\S+)\s`)
-	cmatch := crgx.FindStringSubmatch(line)
-	if cmatch != nil && len(cmatch) > 1 {
-		channel = cmatch[1]
-		if channel == s.Config.Nick {
-			// This must be done to allow PRIVMSG's to users
-			channel = user
+// Only IRC connections measure lag
+func lag(ctx *Context, args []string) error {
+	irc, ok := ctx.Transport.(*Connection)
+	if !ok {
+		ctx.Reply("There is no server to measure the lag to.")
+		return nil
+	}
+	if lag, ok := irc.Lag(); ok {
+		ctx.Reply("Lag to " + irc.Hostname + " is " + lag.String())
+	} else {
+		ctx.Reply("Lag to " + irc.Hostname + " has not been measured yet")
+	}
+	return nil
+}
+
+// Messages sent to a configured channel only go to the plugins enabled there
+func (s *GomrService) enabledPlugins(target string) (plugins []Plugin) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	channelConfig := s.Config.ChannelConfig(target)
+	for _, p := range s.Plugins {
+		if channelConfig == nil || channelConfig.PluginEnabled(PluginName(p)) {
+			plugins = append(plugins, p)
 		}
-		glog.Infoln("channel:", channel)
 	}
+	return plugins
+}
 
-	mrgx = regexp.MustCompile(`\sPRIVMSG\s\S+\s:(.*)`)
-	mmatch := mrgx.FindStringSubmatch(line)
-	if mmatch != nil && len(mmatch) > 1 {
-		msg = mmatch[1]
-		glog.Infoln("message:", msg)
+// PluginName returns the name used to enable a plugin in a channel's
+//   configuration, the lowercased type name without "Plugin" (e.g. "karma"),
+//   unless the plugin is a Namer
+func PluginName(p Plugin) string {
+	if n, ok := p.(Namer); ok {
+		return strings.ToLower(n.PluginName())
 	}
+	t := reflect.TypeOf(p)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return strings.ToLower(strings.TrimSuffix(t.Name(), "Plugin"))
+}
 
-	if msg != "" {
-		// Check if the help command was sent
-		if Match(msg, `(?i)`+s.Config.Nick+`[:,.]*\shelp`) {
-			var helpText []string
-			for _, plugin := range s.Plugins {
-				texts := plugin.Help()
-				helpText = append(helpText, texts...)
-			}
-			for _, text := range helpText {
-				// For now, always send help text to the user in a private message
-				//  It is likely the help text will get too big for a channel.
-				conn.SendTo(user, text)
-			}
-			conn.SendTo(user, "Want to contribute? Source: "+s.Config.Source)
-			if channel != user {
-				conn.SendTo(channel, user+", help information sent via private message")
-			}
+// Parse a raw line as if it was sent from the server, see HandleMessage()
+func (s *GomrService) ParseLine(line string, conn Transport) {
+	msg, err := ParseMessage(line)
+	if err != nil {
+		glog.Infoln("ERROR: Unable to parse line from server:", err)
+		return
+	}
+	s.HandleMessage(msg, conn)
+}
+
+// Main method to handle messages sent from the server
+// Commands are run by the Router, any other message is passed to the Parse()
+//   method of each plugin enabled where it was sent, in order, until one
+//   handles it. See sortPlugins()
+func (s *GomrService) HandleMessage(msg *Message, conn Transport) {
+	glog.Infoln(msg)
+
+	plugins := s.enabledPlugins(msg.Target())
+	router := s.router()
+	ctx := NewContext(msg, conn, s.config())
+
+	// Commands go only to the plugin they belong to
+	enabled := make(map[string]bool)
+	for _, p := range plugins {
+		enabled[PluginName(p)] = true
+	}
+	if router != nil {
+		route := func(ctx *Context) (bool, error) {
+			return router.Route(ctx, enabled), nil
+		}
+		if s.runPlugin("commands", ctx, route) {
 			return
 		}
+	}
 
-		for _, p := range s.Plugins {
-			err := p.Parse(user, channel, msg, conn)
-			if err != nil {
-				glog.Infoln("ERROR in plugin", reflect.TypeOf(p), ":", err)
-			}
+	for _, p := range plugins {
+		if s.runPlugin(PluginName(p), ctx, p.Parse) {
+			return
 		}
 	}
 }
 
 // Respond to pings from the irc server to keep the server alive
-func respondToPing(line string, conn *Connection) {
-	hrgx := regexp.MustCompile(`^PING :(\S+)`)
-	hmatch := hrgx.FindStringSubmatch(line)
-	var pongHost string
-	if hmatch != nil && len(hmatch) > 1 {
-		pongHost = hmatch[1]
-	} else {
-		glog.Fatalln("Could not find host to ping in received ping string: ", line)
+func respondToPing(msg *Message, conn *Connection) {
+	pongHost := msg.Trailing()
+	if pongHost == "" {
+		glog.Infoln("ERROR: Could not find host to ping in received ping:", msg)
+		return
 	}
 
-	conn.Send("PONG " + pongHost)
-	glog.Infoln("PONG " + pongHost)
+	conn.Send("PONG :" + pongHost)
+	glog.Infoln("PONG :" + pongHost)
 }
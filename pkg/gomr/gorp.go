@@ -6,8 +6,23 @@ import (
 	"github.com/go-gorp/gorp"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/golang/glog"
+	_ "github.com/mattn/go-sqlite3"
 )
 
+// Supported database drivers, see DbConfig.Driver
+const (
+	DriverMySQL  = "mysql"
+	DriverSQLite = "sqlite3"
+)
+
+// Open the configured database, see InitDB() and InitSqliteDB()
+func OpenDB(d *DbConfig) (*gorp.DbMap, error) {
+	if d.Driver == DriverSQLite {
+		return InitSqliteDB(d.Name)
+	}
+	return InitDB(d.Hostname, d.Port, d.Username, d.Password, d.Name)
+}
+
 // Create and return a Database object
 func InitDB(host, port, user, password, dbname string) (db *gorp.DbMap, err error) {
 	connectionString := fmt.Sprintf("%s:%s@%s([%s]:%s)/%s",
@@ -27,19 +42,77 @@ func InitDB(host, port, user, password, dbname string) (db *gorp.DbMap, err erro
 	}
 
 	// Set up gorp mappings
-	db = &gorp.DbMap{Db: dbCon, Dialect: gorp.MySQLDialect{"InnoDB", "UTF8"}}
+	db = &gorp.DbMap{Db: dbCon, Dialect: gorp.MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"}}
 
 	defineTables(db)
 	if err := db.CreateTablesIfNotExists(); err != nil {
 		glog.Fatalln("Unable to create tables:", err)
 	}
+	if err := migrateTables(db); err != nil {
+		glog.Fatalln("Unable to migrate tables:", err)
+	}
 
 	return db, err
 }
 
+// Create and return a SQLite database object. The path may be ":memory:" for
+//   a database that only lasts as long as gomr is running.
+func InitSqliteDB(path string) (db *gorp.DbMap, err error) {
+	var dbCon *sql.DB
+	dbCon, err = sql.Open(DriverSQLite, path)
+	if err != nil {
+		return
+	}
+	// Every connection to ":memory:" would get its own empty database
+	dbCon.SetMaxOpenConns(1)
+
+	err = dbCon.Ping()
+	if err != nil {
+		return
+	}
+
+	db = &gorp.DbMap{Db: dbCon, Dialect: gorp.SqliteDialect{}}
+
+	// SQLite databases are always created with the current columns, there
+	//   is nothing to migrate.
+	defineTables(db)
+	if err = db.CreateTablesIfNotExists(); err != nil {
+		return nil, fmt.Errorf("Unable to create tables: %s", err)
+	}
+	return db, nil
+}
+
 func defineTables(Dbm *gorp.DbMap) {
 	// Column sizes and options are defined on the database table structs,
 	//   there is no reason to set it here.
 	_ = Dbm.AddTableWithName(Karma{}, "karma").SetKeys(true, "Id")
 	_ = Dbm.AddTableWithName(Factoid{}, "factoids").SetKeys(true, "Id")
+	_ = Dbm.AddTableWithName(PluginData{}, "plugin_data").SetKeys(true, "Id")
+}
+
+// Tables created by older versions of gomr are missing columns added since.
+//   CreateTablesIfNotExists() won't touch them, so add the columns here.
+func migrateTables(Dbm *gorp.DbMap) error {
+	for _, table := range []string{"karma", "factoids"} {
+		err := addColumnIfNotExists(Dbm, table, "namespace", "varchar(100) not null default ''")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addColumnIfNotExists(Dbm *gorp.DbMap, table, column, definition string) error {
+	count, err := Dbm.SelectInt("select count(*) from information_schema.columns "+
+		"where table_schema = database() and table_name = ? and column_name = ?", table, column)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	glog.Infof("Adding column %s to table %s", column, table)
+	_, err = Dbm.Exec(fmt.Sprintf("alter table %s add column %s %s", table, column, definition))
+	return err
 }
@@ -3,72 +3,51 @@ package gomr
 import (
 	"database/sql"
 	"errors"
-	"regexp"
 	"strconv"
 
 	"github.com/go-gorp/gorp"
 )
 
 type KarmaPlugin struct {
-	Db   *gorp.DbMap
-	Nick string
+	Db *gorp.DbMap
+}
+
+func init() {
+	RegisterPlugin("karma", func(config *Config, db *gorp.DbMap) Plugin {
+		return KarmaPlugin{Db: db}
+	})
 }
 
 type Karma struct {
-	Id     int    `db:"id, primarykey, autoincrement"`
-	User   string `db:"user, size:500"`
-	Points int    `db:"points"`
+	Id        int    `db:"id, primarykey, autoincrement"`
+	User      string `db:"user, size:500"`
+	Points    int    `db:"points"`
+	Namespace string `db:"namespace, size:100"`
 }
 
 func (kp KarmaPlugin) Register() (err error) {
 	return nil
 }
 
-func (kp KarmaPlugin) Parse(sender, channel, input string, conn *Connection) (err error) {
-	if Match(input, `(?i)`+kp.Nick+`[\S]?\s+rank`) {
-		if Match(input, `(?i)`+kp.Nick+`[\S]?\s+rank\s+[\S]+`) {
-			urgx, _ := regexp.Compile(`\s+rank\s+([\S]+)`)
-			umatch := urgx.FindStringSubmatch(input)
-			if umatch != nil && len(umatch) > 1 {
-				user := umatch[1]
-				rank, points, err := kp.FindRank(user)
-				if err != nil {
-					if err == sql.ErrNoRows {
-						conn.SendTo(channel, user+" has never had karma modified.")
-						return nil
-					}
-					return err
-				}
-				conn.SendTo(channel, user+" is "+rank+" with "+strconv.Itoa(points)+" points of karma")
-			}
-		} else {
-			klist, err := kp.GetKarmaByPoints()
-			if err != nil {
-				return err
-			}
-
-			if len(klist) == 0 {
-				return nil
-			}
+// Karma goes after factoids, so "gomr: foo is bar++" is only a factoid
+func (kp KarmaPlugin) Priority() int {
+	return 10
+}
 
-			for i, k := range klist {
-				rank := addSuffix(i + 1)
-				conn.SendTo(sender, rank+") "+k.User+" with "+strconv.Itoa(k.Points)+" points")
-				if i > 9 {
-					break
-				}
-			}
-		}
-		return nil
+func (kp KarmaPlugin) Parse(ctx *Context) (handled bool, err error) {
+	if ctx.Command != "PRIVMSG" {
+		return false, nil
 	}
+	sender := ctx.Sender
+	input := ctx.Trailing()
 
 	if !Match(input, `\S+(\+\+|--|—)`) {
-		return nil
+		return false, nil
 	}
 
-	if channel == sender {
-		conn.SendTo(sender, "Karma can only be modified in a public channel.")
-		return nil
+	if ctx.Private {
+		ctx.Reply("Karma can only be modified in a public channel.")
+		return true, nil
 	}
 
 	change := 0
@@ -83,40 +62,92 @@ func (kp KarmaPlugin) Parse(sender, channel, input string, conn *Connection) (er
 		}
 	}
 	if change != 0 {
-		if user == sender {
-			conn.SendTo(channel, "I will not allow you to modify your own karma "+sender+".")
-			return nil
+		// Karma follows the account of users logged in to one rather than their
+		//   current nick, see State.Identity()
+		identity := ctx.Transport.Identity(user)
+		if user == sender || identity == ctx.Transport.Identity(sender) {
+			ctx.Reply("I will not allow you to modify your own karma " + sender + ".")
+			return true, nil
 		}
 		var k Karma
-		k, err = kp.FindOrCreateKarma(user)
+		k, err = kp.FindOrCreateKarma(identity, ctx.Namespace)
 		if err != nil {
-			return errors.New("Unable to find or create karma entry:" + err.Error())
+			return true, errors.New("Unable to find or create karma entry:" + err.Error())
 		}
 		k.Points = k.Points + change
 		err = kp.Update(k)
 		if err != nil {
-			return errors.New("Unable to update karma entry:" + err.Error())
+			return true, errors.New("Unable to update karma entry:" + err.Error())
+		}
+		ctx.Reply(user + " now has " + strconv.Itoa(k.Points) + " karma.")
+		return true, nil
+	}
+	return false, nil
+}
+
+func (kp KarmaPlugin) Commands() []Command {
+	return []Command{
+		{Name: "rank", Args: "[user]", Help: "Show the karma of a user, or send the top ten by private message", Run: kp.rank},
+		// Admins can merge karma kept under two names, e.g. an old nick into an account
+		{Name: "karma merge", Args: "<from> <into>", Help: "Add the karma of one name to another", Admin: true, Run: kp.merge},
+	}
+}
+
+func (kp KarmaPlugin) rank(ctx *Context, args []string) error {
+	if user := args[0]; user != "" {
+		rank, points, err := kp.FindRank(ctx.Transport.Identity(user), ctx.Namespace)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				ctx.Reply(user + " has never had karma modified.")
+				return nil
+			}
+			return err
 		}
-		conn.SendTo(channel, user+" now has "+strconv.Itoa(k.Points)+" karma.")
+		ctx.Reply(user + " is " + rank + " with " + strconv.Itoa(points) + " points of karma")
+		return nil
 	}
+
+	klist, err := kp.GetKarmaByPoints(ctx.Namespace)
+	if err != nil {
+		return err
+	}
+	for i, k := range klist {
+		rank := addSuffix(i + 1)
+		ctx.ReplyPrivate(rank + ") " + k.User + " with " + strconv.Itoa(k.Points) + " points")
+		if i > 9 {
+			break
+		}
+	}
+	return nil
+}
+
+func (kp KarmaPlugin) merge(ctx *Context, args []string) error {
+	from, into := args[0], args[1]
+	k, err := kp.Merge(from, into, ctx.Namespace)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			ctx.Reply(from + " has never had karma modified.")
+			return nil
+		}
+		return errors.New("Unable to merge karma entries:" + err.Error())
+	}
+	ctx.Reply("Merged " + from + " into " + into + ", who now has " + strconv.Itoa(k.Points) + " karma.")
 	return nil
 }
 
 func (kp KarmaPlugin) Help() (texts []string) {
 	texts = append(texts, "<name>++ or <name>--")
-	texts = append(texts, kp.Nick+"[:] rank")
-	texts = append(texts, kp.Nick+"[:] rank <user>")
 	return texts
 }
 
-func (kp KarmaPlugin) FindRank(user string) (rank string, points int, err error) {
+func (kp KarmaPlugin) FindRank(user, namespace string) (rank string, points int, err error) {
 	var k Karma
 	user = CanonicalizeIrcNick(user)
-	err = kp.Db.SelectOne(&k, "select * from karma where user=?", user)
+	err = kp.Db.SelectOne(&k, "select * from karma where user=? and namespace=?", user, namespace)
 	if err != nil {
 		return
 	}
-	klist, err := kp.GetKarmaByPoints()
+	klist, err := kp.GetKarmaByPoints(namespace)
 	if err != nil {
 		return
 	}
@@ -135,13 +166,14 @@ func (kp KarmaPlugin) FindRank(user string) (rank string, points int, err error)
 	return
 }
 
-func (kp KarmaPlugin) FindOrCreateKarma(u string) (k Karma, err error) {
+func (kp KarmaPlugin) FindOrCreateKarma(u, namespace string) (k Karma, err error) {
 	u = CanonicalizeIrcNick(u)
-	err = kp.Db.SelectOne(&k, "select * from karma where user=?", u)
+	err = kp.Db.SelectOne(&k, "select * from karma where user=? and namespace=?", u, namespace)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			k.Points = 0
 			k.User = u
+			k.Namespace = namespace
 			err = kp.Db.Insert(&k)
 			if err != nil {
 				return
@@ -151,8 +183,32 @@ func (kp KarmaPlugin) FindOrCreateKarma(u string) (k Karma, err error) {
 	return
 }
 
-func (kp KarmaPlugin) GetKarmaByPoints() (klist []Karma, err error) {
-	_, err = kp.Db.Select(&klist, "select * from karma order by points DESC")
+// Add the points of one karma entry to another, and delete the first
+func (kp KarmaPlugin) Merge(from, into, namespace string) (k Karma, err error) {
+	var old Karma
+	err = kp.Db.SelectOne(&old, "select * from karma where user=? and namespace=?", CanonicalizeIrcNick(from), namespace)
+	if err != nil {
+		return
+	}
+	k, err = kp.FindOrCreateKarma(into, namespace)
+	if err != nil {
+		return
+	}
+	if k.Id == old.Id {
+		return
+	}
+
+	k.Points = k.Points + old.Points
+	err = kp.Update(k)
+	if err != nil {
+		return
+	}
+	_, err = kp.Db.Delete(&old)
+	return
+}
+
+func (kp KarmaPlugin) GetKarmaByPoints(namespace string) (klist []Karma, err error) {
+	_, err = kp.Db.Select(&klist, "select * from karma where namespace=? order by points DESC", namespace)
 	return
 }
 
@@ -0,0 +1,101 @@
+package gomr
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"plugin"
+	"strings"
+	"sync"
+
+	"github.com/go-gorp/gorp"
+	"github.com/golang/glog"
+)
+
+// PluginAPIVersion is the version of what gomr offers plugins: the Plugin
+//   interface, Context, Transport and the factory's arguments. It goes up
+//   whenever they change, and plugins built for another version are refused.
+const PluginAPIVersion = 1
+
+// Paths of the plugins already loaded, Go plugins can't be unloaded or
+//   loaded twice
+var (
+	loadedMu sync.Mutex
+	loaded   = make(map[string]bool)
+)
+
+// LoadPlugins registers the plugins built with -buildmode=plugin in dir,
+//   each under its file name without ".so", which must match PluginName()
+//   (e.g. weather.so for WeatherPlugin). Each must export:
+//     var GomrAPIVersion = gomr.PluginAPIVersion
+//     func NewPlugin(config *gomr.Config, db *gorp.DbMap) gomr.Plugin
+//   Plugins that can't be loaded are skipped with a warning, an error is
+//   only returned if dir can't be read. Plugins already loaded are skipped,
+//   so it may be called again to load plugins added to dir since.
+func LoadPlugins(dir string) error {
+	loadedMu.Lock()
+	defer loadedMu.Unlock()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("Unable to read the plugin directory: %s", err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".so" {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSuffix(file.Name(), ".so"))
+		path := filepath.Join(dir, file.Name())
+		if loaded[path] {
+			continue
+		}
+		loaded[path] = true
+
+		if _, ok := lookupPlugin(name); ok {
+			glog.Infof("WARNING: Not loading %s, a plugin named %s already exists", path, name)
+			continue
+		}
+		factory, err := loadPlugin(path)
+		if err != nil {
+			glog.Infof("WARNING: Unable to load plugin %s: %s", path, err)
+			continue
+		}
+		RegisterPlugin(name, factory)
+		glog.Infof("Loaded plugin %s from %s", name, path)
+	}
+	return nil
+}
+
+// Open a plugin file and check it was built for this version of gomr
+func loadPlugin(path string) (PluginFactory, error) {
+	// Go itself refuses plugins built with another Go version, or against
+	//   different sources of the packages gomr shares with them
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s (it must be built with the same Go version and gomr sources as gomr)", err)
+	}
+
+	sym, err := p.Lookup("GomrAPIVersion")
+	if err != nil {
+		return nil, errors.New("It doesn't export GomrAPIVersion")
+	}
+	version, ok := sym.(*int)
+	if !ok {
+		return nil, fmt.Errorf("GomrAPIVersion is a %T, not an int", sym)
+	}
+	if *version != PluginAPIVersion {
+		return nil, fmt.Errorf("It was built for plugin API version %d, gomr supports version %d", *version, PluginAPIVersion)
+	}
+
+	sym, err = p.Lookup("NewPlugin")
+	if err != nil {
+		return nil, errors.New("It doesn't export NewPlugin")
+	}
+	newPlugin, ok := sym.(func(*Config, *gorp.DbMap) Plugin)
+	if !ok {
+		return nil, fmt.Errorf("NewPlugin is a %T, not a func(*gomr.Config, *gorp.DbMap) gomr.Plugin", sym)
+	}
+	return PluginFactory(newPlugin), nil
+}
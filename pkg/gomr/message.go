@@ -0,0 +1,206 @@
+package gomr
+
+import (
+	"errors"
+	"strings"
+)
+
+// Message is a single line received from (or sent to) the irc server, parsed
+//   according to RFC 1459/2812 with the IRCv3 message-tags extension.
+// Example lines from server:
+// @time=2016-02-22T13:37:58.000Z :tim!~tim@example.com PRIVMSG #test11123 :This is a test string
+// :tim!~tim@example.com NICK :timbo
+// :irc.example.com 001 gomr :Welcome to the Internet Relay Network gomr
+// PING :irc.example.com
+type Message struct {
+	// IRCv3 tags, unescaped. Tags without a value map to an empty string.
+	Tags map[string]string
+
+	// The raw prefix (without the leading ':'), along with its parts.
+	//   Server prefixes will only have Nick set, to the server name.
+	Prefix string
+	Nick   string
+	User   string
+	Host   string
+
+	// Command is uppercased, numerics are left as their three digit string.
+	Command string
+
+	// All parameters, the trailing parameter (if any) is always last.
+	Params []string
+}
+
+// ParseMessage parses a raw line from the server into a Message.
+//   Any trailing CR/LF is ignored.
+func ParseMessage(line string) (*Message, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.TrimSpace(line) == "" {
+		return nil, errors.New("Unable to parse empty line")
+	}
+
+	m := &Message{}
+
+	if line[0] == '@' {
+		var tags string
+		tags, line = splitWord(line[1:])
+		m.Tags = parseTags(tags)
+	}
+
+	if strings.HasPrefix(line, ":") {
+		m.Prefix, line = splitWord(line[1:])
+		m.Nick, m.User, m.Host = splitPrefix(m.Prefix)
+	}
+
+	var command string
+	command, line = splitWord(line)
+	if command == "" {
+		return nil, errors.New("Unable to find command in line: " + line)
+	}
+	m.Command = strings.ToUpper(command)
+
+	for line != "" {
+		if line[0] == ':' {
+			m.Params = append(m.Params, line[1:])
+			break
+		}
+		var param string
+		param, line = splitWord(line)
+		m.Params = append(m.Params, param)
+	}
+
+	return m, nil
+}
+
+// Param returns the i'th parameter, or an empty string if it doesn't exist.
+func (m *Message) Param(i int) string {
+	if i < 0 || i >= len(m.Params) {
+		return ""
+	}
+	return m.Params[i]
+}
+
+// Trailing returns the last parameter, which for a PRIVMSG or NOTICE is the text.
+func (m *Message) Trailing() string {
+	return m.Param(len(m.Params) - 1)
+}
+
+// Target returns the first parameter, which for a PRIVMSG or NOTICE is the
+//   channel or nick the message was sent to.
+func (m *Message) Target() string {
+	return m.Param(0)
+}
+
+// ReplyTarget returns where a reply to this message should go. Messages sent
+//   directly to nick (a private message) should be answered to the sender.
+func (m *Message) ReplyTarget(nick string) string {
+	target := m.Target()
+	if CanonicalizeIrcNick(target) == CanonicalizeIrcNick(nick) {
+		return m.Nick
+	}
+	return target
+}
+
+// String converts the message back into a raw line, without the CR/LF.
+func (m *Message) String() string {
+	var parts []string
+
+	if len(m.Tags) > 0 {
+		var tags []string
+		for k, v := range m.Tags {
+			if v == "" {
+				tags = append(tags, k)
+			} else {
+				tags = append(tags, k+"="+tagEscaper.Replace(v))
+			}
+		}
+		parts = append(parts, "@"+strings.Join(tags, ";"))
+	}
+
+	if m.Prefix != "" {
+		parts = append(parts, ":"+m.Prefix)
+	}
+
+	parts = append(parts, m.Command)
+
+	for i, p := range m.Params {
+		if i == len(m.Params)-1 && (p == "" || p[0] == ':' || strings.Contains(p, " ")) {
+			p = ":" + p
+		}
+		parts = append(parts, p)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+var tagEscaper = strings.NewReplacer(`\`, `\\`, ";", `\:`, " ", `\s`, "\r", `\r`, "\n", `\n`)
+
+// Split a line on the first run of spaces
+func splitWord(line string) (word, rest string) {
+	line = strings.TrimLeft(line, " ")
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], strings.TrimLeft(line[i:], " ")
+}
+
+// Split a prefix of the form nick!user@host into its parts
+func splitPrefix(prefix string) (nick, user, host string) {
+	nick = prefix
+	if i := strings.IndexByte(nick, '@'); i >= 0 {
+		nick, host = nick[:i], nick[i+1:]
+	}
+	if i := strings.IndexByte(nick, '!'); i >= 0 {
+		nick, user = nick[:i], nick[i+1:]
+	}
+	return
+}
+
+// Parse an IRCv3 tag string, unescaping values as described in
+//   https://ircv3.net/specs/extensions/message-tags
+func parseTags(raw string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(raw, ";") {
+		if tag == "" {
+			continue
+		}
+		key, value := tag, ""
+		if i := strings.IndexByte(tag, '='); i >= 0 {
+			key, value = tag[:i], unescapeTag(tag[i+1:])
+		}
+		tags[key] = value
+	}
+	return tags
+}
+
+func unescapeTag(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i >= len(value) {
+			// A trailing lone backslash is dropped
+			break
+		}
+		switch value[i] {
+		case ':':
+			b.WriteByte(';')
+		case 's':
+			b.WriteByte(' ')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
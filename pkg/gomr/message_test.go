@@ -0,0 +1,129 @@
+package gomr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		line   string
+		tags   map[string]string
+		prefix string
+		nick   string
+		user   string
+		host   string
+		cmd    string
+		params []string
+	}{
+		{
+			line:   ":tim!~tim@example.com PRIVMSG #test :This is a test string\r\n",
+			prefix: "tim!~tim@example.com", nick: "tim", user: "~tim", host: "example.com",
+			cmd: "PRIVMSG", params: []string{"#test", "This is a test string"},
+		},
+		{
+			line: "PING :irc.example.com",
+			cmd:  "PING", params: []string{"irc.example.com"},
+		},
+		{
+			line: "ping irc.example.com",
+			cmd:  "PING", params: []string{"irc.example.com"},
+		},
+		{
+			line:   ":irc.example.com 353 gomr = #chan :@a +b c",
+			prefix: "irc.example.com", nick: "irc.example.com",
+			cmd: "353", params: []string{"gomr", "=", "#chan", "@a +b c"},
+		},
+		{
+			line:   ":tim!~tim@example.com MODE #chan +o bob",
+			prefix: "tim!~tim@example.com", nick: "tim", user: "~tim", host: "example.com",
+			cmd: "MODE", params: []string{"#chan", "+o", "bob"},
+		},
+		{
+			// Only the first ':' marks the trailing parameter
+			line:   ":tim!~tim@example.com PRIVMSG #test ::)",
+			prefix: "tim!~tim@example.com", nick: "tim", user: "~tim", host: "example.com",
+			cmd: "PRIVMSG", params: []string{"#test", ":)"},
+		},
+		{
+			line:   ":tim!~tim@example.com PRIVMSG #test :",
+			prefix: "tim!~tim@example.com", nick: "tim", user: "~tim", host: "example.com",
+			cmd: "PRIVMSG", params: []string{"#test", ""},
+		},
+		{
+			line: `@time=2016-02-22T13:37:58.000Z;account=tim;+draft/reply;msg=a\sb\:c\\d\re\nf\ PRIVMSG #test hi`,
+			tags: map[string]string{
+				"time":         "2016-02-22T13:37:58.000Z",
+				"account":      "tim",
+				"+draft/reply": "",
+				"msg":          "a b;c\\d\re\nf",
+			},
+			cmd: "PRIVMSG", params: []string{"#test", "hi"},
+		},
+		{
+			line:   "@account=tim :tim!~tim@example.com NICK :timbo",
+			tags:   map[string]string{"account": "tim"},
+			prefix: "tim!~tim@example.com", nick: "tim", user: "~tim", host: "example.com",
+			cmd: "NICK", params: []string{"timbo"},
+		},
+	}
+
+	for _, test := range tests {
+		m, err := ParseMessage(test.line)
+		if err != nil {
+			t.Errorf("ParseMessage(%q) returned an error: %s", test.line, err)
+			continue
+		}
+		if len(test.tags) > 0 && !reflect.DeepEqual(m.Tags, test.tags) {
+			t.Errorf("ParseMessage(%q) tags = %q, want %q", test.line, m.Tags, test.tags)
+		}
+		if m.Prefix != test.prefix || m.Nick != test.nick || m.User != test.user || m.Host != test.host {
+			t.Errorf("ParseMessage(%q) prefix = %q (%q, %q, %q), want %q (%q, %q, %q)", test.line,
+				m.Prefix, m.Nick, m.User, m.Host, test.prefix, test.nick, test.user, test.host)
+		}
+		if m.Command != test.cmd {
+			t.Errorf("ParseMessage(%q) command = %q, want %q", test.line, m.Command, test.cmd)
+		}
+		if !reflect.DeepEqual(m.Params, test.params) {
+			t.Errorf("ParseMessage(%q) params = %q, want %q", test.line, m.Params, test.params)
+		}
+	}
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	for _, line := range []string{"", "\r\n", "   ", ":tim!~tim@example.com", "@account=tim"} {
+		if m, err := ParseMessage(line); err == nil {
+			t.Errorf("ParseMessage(%q) = %#v, want an error", line, m)
+		}
+	}
+}
+
+func TestMessageString(t *testing.T) {
+	for _, line := range []string{
+		":tim!~tim@example.com MODE #chan +o bob",
+		":tim!~tim@example.com PRIVMSG #test :This is a test string",
+		":tim!~tim@example.com PRIVMSG #test ::)",
+		":tim!~tim@example.com PRIVMSG #test :",
+		"PING irc.example.com",
+		`@msg=a\sb\:c\\d PRIVMSG #test hi`,
+	} {
+		m, err := ParseMessage(line)
+		if err != nil {
+			t.Fatalf("ParseMessage(%q) returned an error: %s", line, err)
+		}
+		if m.String() != line {
+			t.Errorf("ParseMessage(%q).String() = %q", line, m.String())
+		}
+	}
+}
+
+func TestReplyTarget(t *testing.T) {
+	m, _ := ParseMessage(":tim!~tim@example.com PRIVMSG #test :hi")
+	if got := m.ReplyTarget("gomr"); got != "#test" {
+		t.Errorf("ReplyTarget() of a channel message = %q, want #test", got)
+	}
+	m, _ = ParseMessage(":tim!~tim@example.com PRIVMSG GoMR :hi")
+	if got := m.ReplyTarget("gomr"); got != "tim" {
+		t.Errorf("ReplyTarget() of a private message = %q, want tim", got)
+	}
+}
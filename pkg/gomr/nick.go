@@ -0,0 +1,107 @@
+package gomr
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// How often to try to get our configured nick back while using another
+const nickRegainInterval = 5 * time.Minute
+
+// Nick returns our current nick, as confirmed by the server. This may not be
+//   the configured nick if it was taken when we connected.
+func (c *Connection) Nick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick
+}
+
+// Returns true if nick is our current nick
+func (c *Connection) IsMe(nick string) bool {
+	return CanonicalizeIrcNick(nick) == CanonicalizeIrcNick(c.Nick())
+}
+
+// Pick the nick to try after the server rejected the last one. The configured
+//   alternative nicks are tried in order, then the configured nick with a
+//   random number.
+func (c *Connection) nextNick() string {
+	c.nickAttempts++
+	if c.nickAttempts <= len(c.config.AltNicks) {
+		return c.config.AltNicks[c.nickAttempts-1]
+	}
+	return c.config.Nick + strconv.Itoa(rand.Intn(9000)+1000)
+}
+
+// Keep track of our nick from the messages the server sends
+func (c *Connection) updateNick(msg *Message) {
+	var send []string
+
+	c.mu.Lock()
+	primary := CanonicalizeIrcNick(c.config.Nick)
+	self := CanonicalizeIrcNick(msg.Nick) == CanonicalizeIrcNick(c.nick)
+	switch msg.Command {
+	case "001":
+		// RPL_WELCOME, the first parameter is the nick we registered with
+		c.nick = msg.Param(0)
+		c.registered = true
+		if CanonicalizeIrcNick(c.nick) != primary {
+			glog.Infoln("Registered as", c.nick, "instead of", c.config.Nick)
+			go c.regainLoop()
+		}
+
+	case "432", "433", "436", "437":
+		// ERR_ERRONEUSNICKNAME, ERR_NICKNAMEINUSE, ERR_NICKCOLLISION, ERR_UNAVAILRESOURCE
+		//   After registration, these can only be a failed attempt to regain our nick.
+		if !c.registered {
+			glog.Infoln("Nick", msg.Param(1), "is unavailable:", msg.Trailing())
+			c.nick = c.nextNick()
+			send = append(send, "NICK "+c.nick)
+		}
+
+	case "NICK":
+		if self {
+			glog.Infoln("Nick changed from", c.nick, "to", msg.Trailing())
+			c.nick = msg.Trailing()
+		} else if CanonicalizeIrcNick(msg.Nick) == primary {
+			// Whoever had our nick has changed theirs
+			send = append(send, "NICK "+c.config.Nick)
+		}
+
+	case "QUIT":
+		if !self && CanonicalizeIrcNick(msg.Nick) == primary {
+			send = append(send, "NICK "+c.config.Nick)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, line := range send {
+		c.Send(line)
+	}
+}
+
+// Periodically try to get our configured nick back until we have it. If we
+//   have a NickServ password, ask NickServ to disconnect whoever is using it.
+func (c *Connection) regainLoop() {
+	ticker := time.NewTicker(nickRegainInterval)
+	defer ticker.Stop()
+
+	for {
+		config := c.settings()
+		if c.IsMe(config.Nick) {
+			return
+		}
+		if config.NickServPassword != "" {
+			c.sendSecret("PRIVMSG NickServ :GHOST " + config.Nick + " " + config.NickServPassword)
+		}
+		c.Send("NICK " + config.Nick)
+
+		select {
+		case <-ticker.C:
+		case <-c.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package gomr
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Nicks taken on the fake server are refused with ERR_NICKNAMEINUSE
+func nickServer(t *testing.T, taken ...string) (*fakeServer, chan string) {
+	nicks := make(chan string, 100)
+	server := newFakeServer(t, func(reply func(string), line string) bool {
+		if !strings.HasPrefix(line, "NICK ") {
+			return true
+		}
+		nick := strings.TrimPrefix(line, "NICK ")
+		nicks <- nick
+		for _, n := range taken {
+			if n == nick {
+				reply(":irc.example.com 433 * " + nick + " :Nickname is already in use")
+				return true
+			}
+		}
+		welcome(reply, line)
+		return true
+	})
+	return server, nicks
+}
+
+func TestNickInUse(t *testing.T) {
+	server, nicks := nickServer(t, "gomr", "gomr_", "gomr__")
+	config := server.config()
+	config.AltNicks = []string{"gomr_", "gomr__"}
+	c, err := NewConnection(config)
+	if err != nil {
+		t.Fatal("Registration failed:", err)
+	}
+	defer c.Close()
+
+	var tried []string
+	for len(tried) < 4 {
+		select {
+		case nick := <-nicks:
+			tried = append(tried, nick)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Only tried the nicks %q", tried)
+		}
+	}
+	if tried[0] != "gomr" || tried[1] != "gomr_" || tried[2] != "gomr__" || !regexp.MustCompile(`^gomr\d{4}$`).MatchString(tried[3]) {
+		t.Errorf("Tried the nicks %q, want gomr, the alternatives, then gomr with a number", tried)
+	}
+	if c.Nick() != tried[3] {
+		t.Errorf("Nick() = %q, want %q", c.Nick(), tried[3])
+	}
+
+	// Registered with another nick, we try to get ours back
+	select {
+	case nick := <-nicks:
+		if nick != "gomr" {
+			t.Errorf("Tried to regain the nick %q, want gomr", nick)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Never tried to regain our nick")
+	}
+}
+
+func TestNickRegained(t *testing.T) {
+	c, read := pipeConnection(t)
+	receive(t, c, ":irc.example.com 001 gomr_ :Welcome")
+	read(1) // The regain loop's first attempt
+
+	// Whoever has our nick changes theirs, or quits
+	receive(t, c, ":gomr!~gomr@example.com NICK :someone")
+	if lines := read(1); lines[0] != "NICK gomr\r\n" {
+		t.Errorf("Sent %q when our nick was freed, want NICK gomr", lines[0])
+	}
+	receive(t, c, ":gomr!~gomr@example.com QUIT :bye")
+	if lines := read(1); lines[0] != "NICK gomr\r\n" {
+		t.Errorf("Sent %q when our nick was freed, want NICK gomr", lines[0])
+	}
+
+	// A failed attempt after registration doesn't pick another nick
+	receive(t, c, ":irc.example.com 433 gomr_ gomr :Nickname is already in use")
+	read(0)
+
+	receive(t, c, ":gomr_!~gomr@example.com NICK :gomr")
+	if !c.IsMe("GOMR") {
+		t.Errorf("Nick() = %q after our NICK, want gomr", c.Nick())
+	}
+}
@@ -0,0 +1,124 @@
+package gomr
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Lines sent to the server, including the CR/LF, may be at most 512 bytes
+const maxLineLength = 512
+
+// Used in place of our user and host until the server tells us what they are
+//   (USERLEN and HOSTLEN on most servers)
+var unknownUser = strings.Repeat("x", 10)
+var unknownHost = strings.Repeat("x", 63)
+
+// Added to the last line sent when more are waiting, see Connection.More()
+const moreSuffix = " (more)"
+
+// Mask returns the nick!user@host other users see our messages from
+func (c *Connection) Mask() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	user, host := c.user, c.host
+	if user == "" {
+		user = unknownUser
+	}
+	if host == "" {
+		host = unknownHost
+	}
+	return c.nick + "!" + user + "@" + host
+}
+
+// The server relays our messages prefixed with our mask, which counts
+//   towards the line length limit. Returns the maximum length of the text
+//   of a message with the given command and target.
+func (c *Connection) maxTextLength(command, target string) int {
+	overhead := len(":"+c.Mask()+" "+command+" "+target+" :") + len("\r\n")
+	return maxLineLength - overhead
+}
+
+// Split text into lines of at most max bytes, preferring to split between
+//   words and never splitting a multi-byte character.
+func splitText(text string, max int) []string {
+	if max < utf8.UTFMax {
+		max = utf8.UTFMax
+	}
+
+	var lines []string
+	for len(text) > max {
+		cut := max
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			// Not valid UTF-8, there is no character to keep whole
+			cut = max
+		}
+		if space := strings.LastIndexByte(text[:cut+1], ' '); space > 0 {
+			lines = append(lines, strings.TrimRight(text[:space], " "))
+			text = strings.TrimLeft(text[space:], " ")
+		} else {
+			lines = append(lines, text[:cut])
+			text = text[cut:]
+		}
+	}
+	if text != "" || len(lines) == 0 {
+		lines = append(lines, text)
+	}
+	return lines
+}
+
+// Split text into the lines that should be sent to target now. If there are
+//   more than the configured MaxLines, the rest are saved for More().
+func (c *Connection) page(target, text string) []string {
+	max := c.maxTextLength("PRIVMSG", target)
+	lines := splitText(text, max)
+
+	maxLines := c.settings().MaxLines
+	if maxLines <= 0 || len(lines) <= maxLines {
+		return lines
+	}
+
+	// Leave room to tell the user there is more to see
+	lines = splitText(text, max-len(moreSuffix))
+	c.mu.Lock()
+	c.more[CanonicalizeIrcNick(target)] = lines[maxLines:]
+	c.mu.Unlock()
+
+	lines = lines[:maxLines]
+	lines[maxLines-1] += moreSuffix
+	return lines
+}
+
+// More sends target the next page of lines saved by the last message sent to
+//   it. Returns false if there was nothing more to send.
+func (c *Connection) More(target string) bool {
+	if !ValidTarget(target) {
+		return false
+	}
+	page := c.nextPage(CanonicalizeIrcNick(target))
+	for _, line := range page {
+		c.queue.push(target, "PRIVMSG "+target+" :"+line)
+	}
+	return len(page) > 0
+}
+
+// Remove and return the next page of lines saved for key. Everything left is
+//   returned if MaxLines has been set to 0 since they were saved.
+func (c *Connection) nextPage(key string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lines := c.more[key]
+	maxLines := c.config.MaxLines
+	if maxLines <= 0 || maxLines >= len(lines) {
+		delete(c.more, key)
+		return lines
+	}
+	page := append([]string{}, lines[:maxLines]...)
+	page[len(page)-1] += moreSuffix
+	c.more[key] = lines[maxLines:]
+	return page
+}
@@ -0,0 +1,164 @@
+package gomr
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitText(t *testing.T) {
+	tests := []struct {
+		text string
+		max  int
+		want []string
+	}{
+		{"", 10, []string{""}},
+		{"hello world", 11, []string{"hello world"}},
+		{"hello world", 10, []string{"hello", "world"}},
+		{"hello   world", 7, []string{"hello", "world"}},
+		{"abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		// max is never less than the longest character
+		{"abcdef", 1, []string{"abcd", "ef"}},
+		// Multi-byte characters on the boundary are kept whole
+		{"aaaé", 4, []string{"aaa", "é"}},
+		{"€€€", 4, []string{"€", "€", "€"}},
+		{"ab €uro", 4, []string{"ab", "€u", "ro"}},
+		// Invalid UTF-8 is cut anywhere
+		{"x is " + strings.Repeat("\x80", 50), 20, []string{"x is", strings.Repeat("\x80", 20), strings.Repeat("\x80", 20), strings.Repeat("\x80", 10)}},
+		{strings.Repeat("\xe2\x82", 5), 4, []string{"\xe2\x82\xe2\x82", "\xe2\x82\xe2\x82", "\xe2\x82"}},
+	}
+	for _, test := range tests {
+		if got := splitText(test.text, test.max); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitText(%q, %d) = %q, want %q", test.text, test.max, got, test.want)
+		}
+	}
+}
+
+func TestSplitTextKeepsEverything(t *testing.T) {
+	text := strings.Repeat("héllo wörld ", 100) + strings.Repeat("€", 200)
+	lines := splitText(text, 50)
+	for _, line := range lines {
+		if len(line) > 50 || !utf8.ValidString(line) {
+			t.Errorf("Line %q is too long or not valid UTF-8", line)
+		}
+	}
+	if got := strings.Replace(strings.Join(lines, ""), " ", "", -1); got != strings.Replace(text, " ", "", -1) {
+		t.Errorf("Text was lost splitting it: %q", got)
+	}
+}
+
+func TestMaxTextLength(t *testing.T) {
+	c, _ := pipeConnection(t)
+	unknown := len(":gomr!"+unknownUser+"@"+unknownHost+" PRIVMSG #test :") + 2
+	if got := c.maxTextLength("PRIVMSG", "#test"); got != maxLineLength-unknown {
+		t.Errorf("maxTextLength() = %d before we know our mask, want %d", got, maxLineLength-unknown)
+	}
+
+	// Our own JOIN tells us our mask
+	receive(t, c, ":gomr!~gomr@example.com JOIN #test")
+	if mask := c.Mask(); mask != "gomr!~gomr@example.com" {
+		t.Fatalf("Mask() = %q", mask)
+	}
+	known := len(":gomr!~gomr@example.com PRIVMSG #test :") + 2
+	if got := c.maxTextLength("PRIVMSG", "#test"); got != maxLineLength-known {
+		t.Errorf("maxTextLength() = %d, want %d", got, maxLineLength-known)
+	}
+}
+
+// Words long enough to fill several lines
+func longText(words int) string {
+	var text []string
+	for i := 0; i < words; i++ {
+		text = append(text, fmt.Sprintf("word%d", i))
+	}
+	return strings.Join(text, " ")
+}
+
+// The text of the PRIVMSG lines written to target, whatever its case,
+//   without the (more) suffixes
+func pagedText(t *testing.T, lines []string, target string) (text []string) {
+	for _, line := range lines {
+		if len(line) > maxLineLength-len(":gomr!~gomr@example.com ") {
+			t.Errorf("Line is %d bytes long: %q", len(line), line)
+		}
+		prefix := "PRIVMSG " + target + " :"
+		if !strings.HasPrefix(strings.ToLower(line), strings.ToLower(prefix)) {
+			t.Fatalf("Unexpected line written: %q", line)
+		}
+		text = append(text, strings.TrimSuffix(strings.TrimSuffix(line[len(prefix):], "\r\n"), moreSuffix))
+	}
+	return text
+}
+
+func TestPager(t *testing.T) {
+	c, read := pipeConnection(t)
+	c.config.MaxLines = 2
+	receive(t, c, ":gomr!~gomr@example.com JOIN #test")
+
+	text := longText(300)
+	all := splitText(text, c.maxTextLength("PRIVMSG", "#test")-len(moreSuffix))
+	if len(all) != 5 {
+		t.Fatalf("The text is %d lines long, the test expects 5", len(all))
+	}
+
+	c.SendTo("#test", text)
+	first := read(2)
+	if !strings.HasSuffix(first[1], moreSuffix+"\r\n") || strings.HasSuffix(first[0], moreSuffix+"\r\n") {
+		t.Errorf("Only the last line should end with %q: %q", moreSuffix, first)
+	}
+
+	// Lines are saved for the target whatever its case
+	if c.More("tim") {
+		t.Error("More() sent lines saved for another target")
+	}
+	if !c.More("#TEST") {
+		t.Fatal("More() had nothing to send")
+	}
+	second := read(2)
+	if !strings.HasSuffix(second[1], moreSuffix+"\r\n") {
+		t.Errorf("The second page should end with %q: %q", moreSuffix, second)
+	}
+	if !c.More("#test") {
+		t.Fatal("More() had nothing to send")
+	}
+	last := read(1)
+	if strings.HasSuffix(last[0], moreSuffix+"\r\n") {
+		t.Errorf("The last page ends with %q: %q", moreSuffix, last)
+	}
+	if c.More("#test") {
+		t.Error("More() sent something after the last page")
+	}
+
+	lines := append(append(first, second...), last...)
+	if got := pagedText(t, lines, "#test"); !reflect.DeepEqual(got, all) {
+		t.Errorf("Pages sent\n%q\nwant\n%q", got, all)
+	}
+}
+
+// Lines saved before MaxLines is turned off are all sent by More()
+func TestMoreAfterMaxLinesChange(t *testing.T) {
+	c, read := pipeConnection(t)
+	c.config.MaxLines = 1
+	receive(t, c, ":gomr!~gomr@example.com JOIN #test")
+	c.SendTo("#test", longText(300))
+	read(1)
+
+	c.Reconfigure(&Config{Nick: "gomr", MaxLines: 0})
+	if !c.More("#test") {
+		t.Fatal("More() had nothing to send")
+	}
+	for _, line := range read(4) {
+		if strings.HasSuffix(line, moreSuffix+"\r\n") {
+			t.Errorf("Line ends with %q when there is nothing more: %q", moreSuffix, line)
+		}
+	}
+
+	// The connection is still usable
+	if c.Nick() != "gomr" {
+		t.Error("Nick() =", c.Nick())
+	}
+	c.SendTo("#test", "hi")
+	read(1)
+}
@@ -0,0 +1,105 @@
+package gomr
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Defaults for how often we ping the server, and how long it has to answer
+//   before the connection is considered dead
+const (
+	defaultPingInterval = time.Minute
+	defaultPingTimeout  = 2 * time.Minute
+
+	// How often the ping loop wakes up to check on the connection, at most.
+	//   It checks at least twice per interval and timeout.
+	pingCheckInterval = 5 * time.Second
+)
+
+// Lag returns how long the server took to answer our last ping. False is
+//   returned if no ping has been answered yet.
+func (c *Connection) Lag() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lag, c.lagKnown
+}
+
+// Ping the server every PingInterval seconds to measure lag, and close the
+//   connection if it doesn't answer within PingTimeout seconds. A half open
+//   connection would otherwise never see another line, or an error.
+func (c *Connection) pingLoop() {
+	config := c.settings()
+	interval := time.Duration(config.PingInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultPingInterval
+	}
+	timeout := time.Duration(config.PingTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultPingTimeout
+	}
+
+	check := pingCheckInterval
+	if interval/2 < check {
+		check = interval / 2
+	}
+	if timeout/2 < check {
+		check = timeout / 2
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+	lastPing := time.Now()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closed:
+			return
+		}
+
+		c.mu.Lock()
+		waiting := c.pingToken != ""
+		sent := c.pingSent
+		c.mu.Unlock()
+
+		if waiting {
+			if time.Since(sent) > timeout {
+				glog.Infof("ERROR: No PONG from %s in %s, closing the connection", c.Hostname, timeout)
+				c.Close()
+				return
+			}
+			continue
+		}
+
+		if time.Since(lastPing) < interval {
+			continue
+		}
+		lastPing = time.Now()
+		token := "gomr-" + strconv.FormatInt(lastPing.UnixNano(), 10)
+
+		c.mu.Lock()
+		c.pingToken = token
+		c.pingSent = lastPing
+		c.mu.Unlock()
+
+		c.Send("PING :" + token)
+	}
+}
+
+// Measure lag when the server answers our ping
+func (c *Connection) updatePing(msg *Message) {
+	if msg.Command != "PONG" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pingToken == "" || msg.Trailing() != c.pingToken {
+		return
+	}
+	c.lag = time.Since(c.pingSent)
+	c.lagKnown = true
+	c.pingToken = ""
+	glog.V(2).Infoln("Lag to", c.Hostname, "is", c.lag)
+}
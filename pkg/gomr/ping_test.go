@@ -0,0 +1,68 @@
+package gomr
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Connect to a fake server that answers our pings if pong is true
+func pingServer(t *testing.T, pong bool) *Connection {
+	config := newFakeServer(t, func(reply func(string), line string) bool {
+		welcome(reply, line)
+		if pong && strings.HasPrefix(line, "PING ") {
+			reply(":irc.example.com PONG irc.example.com " + strings.TrimPrefix(line, "PING "))
+		}
+		return true
+	}).config()
+	config.PingInterval = 1
+	config.PingTimeout = 1
+	c, err := NewConnection(config)
+	if err != nil {
+		t.Fatal("Registration failed:", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestPingLag(t *testing.T) {
+	c := pingServer(t, true)
+	if _, ok := c.Lag(); ok {
+		t.Error("Lag() is known before the first ping")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal("The connection was lost:", err)
+		}
+		c.update(msg)
+		if lag, ok := c.Lag(); ok {
+			if lag <= 0 || lag > time.Second {
+				t.Errorf("Lag() = %s", lag)
+			}
+			return
+		}
+	}
+	t.Fatal("The lag was never measured")
+}
+
+func TestPingTimeout(t *testing.T) {
+	c := pingServer(t, false)
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := c.ReadMessage(); err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The connection wasn't closed when the server stopped answering pings")
+	}
+}
@@ -0,0 +1,58 @@
+package gomr
+
+import (
+	"testing"
+)
+
+// A plugin with the named commands, which do nothing
+type commandPlugin struct {
+	name     string
+	commands []string
+	closed   bool
+}
+
+func (p *commandPlugin) PluginName() string               { return p.name }
+func (p *commandPlugin) Register() error                  { return nil }
+func (p *commandPlugin) Parse(ctx *Context) (bool, error) { return false, nil }
+func (p *commandPlugin) Help() []string                   { return nil }
+
+func (p *commandPlugin) Commands() (commands []Command) {
+	for _, name := range p.commands {
+		commands = append(commands, Command{Name: name, Run: func(ctx *Context, args []string) error { return nil }})
+	}
+	return commands
+}
+
+func (p *commandPlugin) Close() error {
+	p.closed = true
+	return nil
+}
+
+// A plugin whose commands clash with another's is disabled, not fatal
+func TestRegisterPluginsCommandClash(t *testing.T) {
+	rank := &commandPlugin{name: "rank", commands: []string{"rank", "top"}}
+	clash := &commandPlugin{name: "clash", commands: []string{"unique", "rank"}}
+	help := &commandPlugin{name: "myhelp", commands: []string{"help"}}
+	other := &commandPlugin{name: "other", commands: []string{"other"}}
+	s := &GomrService{Config: &Config{}, Plugins: []Plugin{rank, clash, help, other}}
+
+	if err := s.RegisterPlugins(); err != nil {
+		t.Fatal("RegisterPlugins() returned an error:", err)
+	}
+	var names []string
+	for _, p := range s.Plugins {
+		names = append(names, PluginName(p))
+	}
+	if len(names) != 2 || names[0] != "rank" || names[1] != "other" {
+		t.Errorf("Plugins enabled are %q, want rank and other", names)
+	}
+	if !clash.closed || !help.closed || rank.closed || other.closed {
+		t.Error("Only the disabled plugins should be closed")
+	}
+	if lines := s.Router.Help("clash", "gomr"); len(lines) != 0 {
+		t.Errorf("Commands of the disabled plugin were added: %q", lines)
+	}
+	if lines := s.Router.Help("rank", "gomr"); len(lines) != 2 {
+		t.Errorf("Commands of the rank plugin are %q", lines)
+	}
+}
@@ -0,0 +1,151 @@
+package gomr
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Default flood protection, most servers allow a short burst of lines
+//   followed by roughly one line per second.
+const (
+	defaultSendBurst = 5
+	defaultSendRate  = 1.0
+
+	// Lines queued for a single target beyond this are dropped
+	maxQueuedPerTarget = 50
+)
+
+// sendQueue holds lines waiting to be written to the server.
+//   Protocol lines (PONG, JOIN, NICK...) are always sent first. Messages are
+//   queued per target and sent round-robin, so a long reply to one user
+//   doesn't hold up replies in a channel.
+type sendQueue struct {
+	mu       sync.Mutex
+	priority []string
+	targets  map[string][]string
+	order    []string // targets with lines waiting, in the order to send them
+	ready    chan struct{}
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{
+		targets: make(map[string][]string),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// Queue a protocol line, to be sent before any messages
+func (q *sendQueue) pushPriority(line string) {
+	q.mu.Lock()
+	q.priority = append(q.priority, line)
+	q.mu.Unlock()
+	q.signal()
+}
+
+// Queue a line sent to target behind any other lines for that target
+func (q *sendQueue) push(target, line string) {
+	target = CanonicalizeIrcNick(target)
+
+	q.mu.Lock()
+	lines, waiting := q.targets[target]
+	if len(lines) >= maxQueuedPerTarget {
+		q.mu.Unlock()
+		glog.Infoln("Send queue for", target, "is full, dropping:", line)
+		return
+	}
+	q.targets[target] = append(lines, line)
+	if !waiting {
+		q.order = append(q.order, target)
+	}
+	q.mu.Unlock()
+	q.signal()
+}
+
+// Remove and return the next line to send, if there is one
+func (q *sendQueue) pop() (line string, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.priority) > 0 {
+		line, q.priority = q.priority[0], q.priority[1:]
+		return line, true
+	}
+
+	if len(q.order) == 0 {
+		return "", false
+	}
+	target := q.order[0]
+	q.order = q.order[1:]
+	lines := q.targets[target]
+	line = lines[0]
+	if len(lines) > 1 {
+		q.targets[target] = lines[1:]
+		q.order = append(q.order, target)
+	} else {
+		delete(q.targets, target)
+	}
+	return line, true
+}
+
+// Returns true if any lines are waiting
+func (q *sendQueue) waiting() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.priority) > 0 || len(q.order) > 0
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// tokenBucket allows a burst of lines, then limits to rate lines per second
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(burst int, rate float64) *tokenBucket {
+	if burst <= 0 {
+		burst = defaultSendBurst
+	}
+	if rate <= 0 {
+		rate = defaultSendRate
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Block until a line may be sent, returns false if done is closed first
+func (b *tokenBucket) wait(done <-chan struct{}) bool {
+	for {
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+
+		if b.tokens >= 1 {
+			b.tokens--
+			return true
+		}
+
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		select {
+		case <-time.After(delay):
+		case <-done:
+			return false
+		}
+	}
+}
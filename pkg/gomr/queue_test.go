@@ -0,0 +1,99 @@
+package gomr
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Everything waiting in q, in the order it would be sent
+func drain(q *sendQueue) (lines []string) {
+	for {
+		line, ok := q.pop()
+		if !ok {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestSendQueueOrder(t *testing.T) {
+	q := newSendQueue()
+	q.push("tim", "PRIVMSG tim :1")
+	q.push("tim", "PRIVMSG tim :2")
+	q.push("tim", "PRIVMSG tim :3")
+	q.push("#test", "PRIVMSG #test :1")
+	q.push("Tim", "PRIVMSG Tim :4")
+	q.pushPriority("PONG :irc.example.com")
+	q.push("bob", "PRIVMSG bob :1")
+	q.pushPriority("JOIN #test")
+
+	if !q.waiting() {
+		t.Fatal("waiting() = false with lines queued")
+	}
+	want := []string{
+		// Protocol lines first, in the order they were queued
+		"PONG :irc.example.com",
+		"JOIN #test",
+		// Then one line for each target in turn
+		"PRIVMSG tim :1",
+		"PRIVMSG #test :1",
+		"PRIVMSG bob :1",
+		"PRIVMSG tim :2",
+		"PRIVMSG tim :3",
+		"PRIVMSG Tim :4",
+	}
+	if got := drain(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("Lines sent in the order\n%q\nwant\n%q", got, want)
+	}
+	if q.waiting() {
+		t.Error("waiting() = true once the queue is empty")
+	}
+}
+
+func TestSendQueueFull(t *testing.T) {
+	q := newSendQueue()
+	for i := 0; i < maxQueuedPerTarget+10; i++ {
+		q.push("tim", fmt.Sprint("PRIVMSG tim :", i))
+	}
+	q.push("#test", "PRIVMSG #test :hi")
+	q.pushPriority("PONG :irc.example.com")
+
+	lines := drain(q)
+	if len(lines) != maxQueuedPerTarget+2 {
+		t.Fatalf("%d lines were sent, want %d", len(lines), maxQueuedPerTarget+2)
+	}
+	if last := lines[len(lines)-1]; last != fmt.Sprint("PRIVMSG tim :", maxQueuedPerTarget-1) {
+		t.Errorf("The last line sent is %q, the lines after the limit should be dropped", last)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(3, 20)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		b.wait(nil)
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("The burst of 3 lines took %s", elapsed)
+	}
+
+	// Then one line every 50ms
+	for i := 0; i < 4; i++ {
+		b.wait(nil)
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond || elapsed > 400*time.Millisecond {
+		t.Errorf("4 lines after the burst took %s, want 200ms", elapsed)
+	}
+
+	done := make(chan struct{})
+	close(done)
+	b = newTokenBucket(1, 0.001)
+	if !b.wait(done) {
+		t.Error("wait() returned false with a token left")
+	}
+	if b.wait(done) {
+		t.Error("wait() returned true once done was closed")
+	}
+}
@@ -0,0 +1,108 @@
+package gomr
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReconnect(t *testing.T) {
+	lines := make(chan string, 100)
+	var connections int32
+	server := newFakeServer(t, func(reply func(string), line string) bool {
+		if strings.HasPrefix(line, "NICK ") {
+			atomic.AddInt32(&connections, 1)
+		}
+		switch strings.Fields(line)[0] {
+		case "USER", "NICK", "JOIN":
+			lines <- line
+		}
+		welcome(reply, line)
+
+		// Drop the first connection once every channel is joined
+		return !(line == "JOIN #b" && atomic.LoadInt32(&connections) == 1)
+	})
+
+	config := server.config()
+	config.Channels = []ChannelConfig{{Name: "#a", Key: "secret"}, {Name: "#b"}}
+	config.MaxRetries = 1
+	s := &GomrService{Config: config}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run()
+	}()
+
+	want := []string{"USER gomr 0 * gomr", "NICK gomr", "JOIN #a secret", "JOIN #b"}
+	for connection := 1; connection <= 2; connection++ {
+		for _, w := range want {
+			select {
+			case line := <-lines:
+				if line != w {
+					t.Fatalf("Connection %d sent %q, want %q", connection, line, w)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("Connection %d never sent %q", connection, w)
+			}
+		}
+	}
+
+	// Run gives up once MaxRetries reconnects have failed
+	server.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Run() returned no error after giving up")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run() did not give up after MaxRetries reconnects")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Min: time.Second, Max: 10 * time.Second}
+	limits := []time.Duration{1, 2, 4, 8, 10, 10, 10}
+	for round := 0; round < 2; round++ {
+		for i, limit := range limits {
+			limit *= time.Second
+			delay := b.Next()
+			if delay < limit/2 || delay >= limit {
+				t.Errorf("Attempt %d waits %s, want [%s, %s)", i+1, delay, limit/2, limit)
+			}
+			if b.Attempts() != i+1 {
+				t.Errorf("Attempts() = %d after %d attempts", b.Attempts(), i+1)
+			}
+		}
+		b.Reset()
+	}
+}
+
+// A wrong password won't be right next time, so Run gives up straight away
+func TestRunRegistrationRefused(t *testing.T) {
+	var connections int32
+	server := newFakeServer(t, func(reply func(string), line string) bool {
+		if strings.HasPrefix(line, "NICK ") {
+			atomic.AddInt32(&connections, 1)
+			reply(":irc.example.com 464 * :Password incorrect")
+			return false
+		}
+		return true
+	})
+	s := &GomrService{Config: server.config()}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run()
+	}()
+
+	select {
+	case err := <-done:
+		if regErr, ok := err.(*RegistrationError); !ok || regErr.Numeric != "464" {
+			t.Errorf("Run() returned %v, want the 464 RegistrationError", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run() kept retrying a refused registration")
+	}
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Errorf("Connected %d times, want 1", n)
+	}
+}
@@ -0,0 +1,303 @@
+package gomr
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// How long the server has to accept our registration, how long it has to
+//   finish sending the MOTD once it has, and how long NickServ has to confirm
+//   our identity if we are waiting for it
+const (
+	registrationTimeout = 2 * time.Minute
+	motdTimeout         = 15 * time.Second
+	identifyTimeout     = 30 * time.Second
+)
+
+// RegistrationError is returned by NewConnection when the server refuses
+//   our registration, e.g. because of a bad password or a ban.
+type RegistrationError struct {
+	Numeric string
+	Reason  string
+
+	// Trying again may succeed, e.g. the connection was lost during
+	//   registration. Otherwise it would fail the same way until the
+	//   configuration changes.
+	Temporary bool
+}
+
+func (e *RegistrationError) Error() string {
+	if e.Numeric == "" {
+		return "Registration failed: " + e.Reason
+	}
+	return fmt.Sprintf("Registration failed (%s): %s", e.Numeric, e.Reason)
+}
+
+// The state of our registration with the server, see Connection.register()
+type registration struct {
+	conn   *Connection
+	config *Config
+
+	caps     []string // Capabilities offered by the server in CAP LS
+	capEnd   bool     // Capability negotiation is finished
+	saslDone bool     // SASL authentication succeeded
+	welcomed bool     // RPL_WELCOME received
+	motdDone bool     // End of the MOTD (or no MOTD) received
+}
+
+// Register with the server and wait until it accepts us, then identify with
+//   NickServ and join the configured channels.
+//   The registration state machine moves through:
+//   capability negotiation (and SASL) -> RPL_WELCOME -> MOTD -> NickServ -> JOIN
+func (c *Connection) register() error {
+	r := &registration{conn: c, config: c.config}
+
+	c.Conn.SetReadDeadline(time.Now().Add(registrationTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	// PASS must be sent before any other registration command.
+	//   Capability negotiation holds registration until "CAP END" is sent,
+	//   servers that don't support it will ignore it.
+	if c.config.ServerPassword != "" {
+		c.sendSecret("PASS :" + c.config.ServerPassword)
+	}
+	c.Send("CAP LS 302")
+	c.Send("USER " + c.config.Nick + " 0 * " + c.config.Nick)
+	c.Send("NICK " + c.config.Nick)
+
+	for !r.welcomed || !r.motdDone {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && r.welcomed {
+				glog.Infoln("Timed out waiting for the MOTD, continuing")
+				break
+			}
+			return &RegistrationError{Reason: err.Error(), Temporary: true}
+		}
+		glog.Infoln(msg)
+
+		err = r.handle(msg)
+		if err != nil {
+			return err
+		}
+	}
+	glog.Infoln("Registered with", c.Hostname, "as", c.Nick())
+
+	if c.config.NickServPassword != "" {
+		c.Identify()
+		if c.config.WaitForIdentify {
+			r.waitForIdentify()
+		}
+	}
+
+	for _, channel := range c.Channels {
+		c.Join(channel)
+	}
+	return nil
+}
+
+// Handle a single message received during registration
+func (r *registration) handle(msg *Message) error {
+	switch msg.Command {
+	case "PING":
+		r.conn.Send("PONG :" + msg.Trailing())
+
+	case "CAP":
+		return r.handleCap(msg)
+
+	case "AUTHENTICATE", "900", "902", "903", "904", "905", "906", "907", "908":
+		return r.handleSASL(msg)
+
+	case "001":
+		// RPL_WELCOME, Connection.update() has already recorded our nick.
+		//   Servers without capability negotiation never answered CAP LS.
+		r.welcomed = true
+		r.capEnd = true
+		if r.config.SASLMechanism != "" && !r.saslDone {
+			return &RegistrationError{Reason: "The server does not support SASL authentication"}
+		}
+		// Servers without a MOTD may not say so, don't hold up joining for long
+		r.conn.Conn.SetReadDeadline(time.Now().Add(motdTimeout))
+
+	case "375", "372":
+		// RPL_MOTDSTART, RPL_MOTD
+		glog.V(2).Infoln("MOTD:", msg.Trailing())
+
+	case "376", "422":
+		// RPL_ENDOFMOTD, ERR_NOMOTD
+		r.motdDone = true
+
+	case "463", "464", "465", "466":
+		// ERR_NOPERMFORHOST, ERR_PASSWDMISMATCH, ERR_YOUREBANNEDCREEP, ERR_YOUWILLBEBANNED
+		return &RegistrationError{Numeric: msg.Command, Reason: msg.Trailing()}
+
+	case "ERROR":
+		// Often the server throttling reconnects
+		return &RegistrationError{Reason: msg.Trailing(), Temporary: true}
+	}
+	return nil
+}
+
+// Capabilities that make the server tell us more about the users we see,
+//   see State
+var stateCaps = []string{"multi-prefix", "userhost-in-names", "extended-join", "account-notify", "account-tag"}
+
+// Capabilities we would like the server to enable
+func (r *registration) wantedCaps() (caps []string) {
+	caps = append(caps, stateCaps...)
+	if r.config.SASLMechanism != "" {
+		caps = append(caps, "sasl")
+	}
+	return caps
+}
+
+// Negotiate capabilities with the server.
+//   See https://ircv3.net/specs/extensions/capability-negotiation
+func (r *registration) handleCap(msg *Message) error {
+	switch strings.ToUpper(msg.Param(1)) {
+	case "LS":
+		r.caps = append(r.caps, strings.Fields(msg.Trailing())...)
+		if msg.Param(2) == "*" {
+			// More capabilities follow on another line
+			return nil
+		}
+
+		var request []string
+		for _, want := range r.wantedCaps() {
+			if capOffered(r.caps, want) {
+				request = append(request, want)
+			}
+		}
+		if r.config.SASLMechanism != "" && !saslSupports(r.caps, strings.ToUpper(r.config.SASLMechanism)) {
+			r.endCap()
+			return &RegistrationError{Reason: fmt.Sprintf("SASL %s authentication is not supported by the server", r.config.SASLMechanism)}
+		}
+		if len(request) == 0 {
+			r.endCap()
+			return nil
+		}
+		r.conn.Send("CAP REQ :" + strings.Join(request, " "))
+
+	case "ACK":
+		acked := strings.Fields(msg.Trailing())
+		r.conn.enableCaps(acked)
+		for _, c := range acked {
+			if c == "sasl" {
+				// CAP END is sent once authentication is finished
+				r.conn.Send("AUTHENTICATE " + strings.ToUpper(r.config.SASLMechanism))
+				return nil
+			}
+		}
+		r.endCap()
+
+	case "NAK":
+		// The whole request is refused if any capability is, so try again
+		//   with just the one we need
+		naked := strings.Fields(msg.Trailing())
+		if r.config.SASLMechanism != "" && len(naked) > 1 {
+			r.conn.Send("CAP REQ :sasl")
+			return nil
+		}
+		r.endCap()
+		if r.config.SASLMechanism != "" {
+			return &RegistrationError{Reason: "The server refused to enable the sasl capability"}
+		}
+	}
+	return nil
+}
+
+func (r *registration) endCap() {
+	if !r.capEnd {
+		r.conn.Send("CAP END")
+		r.capEnd = true
+	}
+}
+
+// Authenticate using the configured SASL mechanism.
+//   See https://ircv3.net/specs/extensions/sasl-3.1
+func (r *registration) handleSASL(msg *Message) error {
+	mechanism := strings.ToUpper(r.config.SASLMechanism)
+
+	switch msg.Command {
+	case "AUTHENTICATE":
+		if msg.Param(0) == "+" {
+			r.conn.sendAuthenticate(saslPayload(r.config))
+		}
+
+	case "900":
+		// RPL_LOGGEDIN
+		glog.Infoln("Logged in:", msg.Trailing())
+
+	case "903":
+		// RPL_SASLSUCCESS
+		r.saslDone = true
+		r.endCap()
+
+	case "907":
+		// ERR_SASLALREADY
+		r.saslDone = true
+		r.endCap()
+
+	default:
+		// ERR_NICKLOCKED, ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED, RPL_SASLMECHS
+		r.endCap()
+		return &RegistrationError{
+			Numeric: msg.Command,
+			Reason:  fmt.Sprintf("SASL %s authentication failed: %s", mechanism, msg.Trailing()),
+		}
+	}
+	return nil
+}
+
+// Wait until NickServ confirms we are identified, so channels that require
+//   it can be joined. Identification failing is logged but not fatal.
+func (r *registration) waitForIdentify() {
+	c := r.conn
+	c.Conn.SetReadDeadline(time.Now().Add(identifyTimeout))
+
+	for {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			glog.Infoln("WARNING: NickServ did not confirm identification, joining channels anyway:", err)
+			return
+		}
+		glog.Infoln(msg)
+
+		switch msg.Command {
+		case "PING":
+			c.Send("PONG :" + msg.Trailing())
+		case "900":
+			// RPL_LOGGEDIN, sent by servers that tie NickServ to accounts
+			glog.Infoln("Identified with NickServ:", msg.Trailing())
+			return
+		case "NOTICE":
+			if !strings.EqualFold(msg.Nick, "NickServ") {
+				continue
+			}
+			text := msg.Trailing()
+			if Match(text, `(?i)(you are now identified|you are now logged in|password accepted|now recognized)`) {
+				glog.Infoln("Identified with NickServ:", text)
+				return
+			}
+			if Match(text, `(?i)(invalid password|password incorrect|not registered)`) {
+				glog.Infoln("WARNING: Unable to identify with NickServ:", text)
+				return
+			}
+		}
+	}
+}
+
+// Returns true if the capability is in the list from CAP LS, which may
+//   include a value, e.g. "sasl=PLAIN,EXTERNAL"
+func capOffered(caps []string, name string) bool {
+	for _, c := range caps {
+		if c == name || strings.HasPrefix(c, name+"=") {
+			return true
+		}
+	}
+	return false
+}
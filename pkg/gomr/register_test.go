@@ -0,0 +1,115 @@
+package gomr
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// A server offering SASL PLAIN, which accepts our credentials if accept
+func saslServer(t *testing.T, accept bool) *fakeServer {
+	return newFakeServer(t, func(reply func(string), line string) bool {
+		switch {
+		case line == "CAP LS 302":
+			reply(":irc.example.com CAP * LS * :multi-prefix")
+			reply(":irc.example.com CAP * LS :sasl=PLAIN,EXTERNAL account-tag")
+		case strings.HasPrefix(line, "CAP REQ :"):
+			reply(":irc.example.com CAP * ACK :" + strings.TrimPrefix(line, "CAP REQ :"))
+		case line == "AUTHENTICATE PLAIN":
+			reply("AUTHENTICATE +")
+		case strings.HasPrefix(line, "AUTHENTICATE "):
+			if accept {
+				reply(":irc.example.com 900 gomr gomr!gomr@example.com gomr :You are now logged in as gomr")
+				reply(":irc.example.com 903 gomr :SASL authentication successful")
+			} else {
+				reply(":irc.example.com 904 gomr :SASL authentication failed")
+			}
+		case line == "CAP END":
+			welcome(reply, "NICK gomr")
+		}
+		return true
+	})
+}
+
+func TestRegisterSASL(t *testing.T) {
+	config := saslServer(t, true).config()
+	config.SASLMechanism = "plain"
+	config.SASLPassword = "secret"
+	c, err := NewConnection(config)
+	if err != nil {
+		t.Fatal("Registration failed:", err)
+	}
+	defer c.Close()
+	if !c.HasCap("sasl") || !c.HasCap("account-tag") {
+		t.Error("The capabilities acknowledged by the server were not enabled")
+	}
+}
+
+func TestRegisterSASLFailure(t *testing.T) {
+	config := saslServer(t, false).config()
+	config.SASLMechanism = "plain"
+	config.SASLPassword = "wrong"
+	_, err := NewConnection(config)
+	if regErr, ok := err.(*RegistrationError); !ok || regErr.Numeric != "904" {
+		t.Fatalf("NewConnection() returned %v, want a 904 RegistrationError", err)
+	}
+}
+
+// A server that never answers CAP LS must not let us in unauthenticated
+func TestRegisterSASLUnsupported(t *testing.T) {
+	config := newFakeServer(t, func(reply func(string), line string) bool {
+		welcome(reply, line)
+		return true
+	}).config()
+	config.SASLMechanism = "plain"
+	config.SASLPassword = "secret"
+	c, err := NewConnection(config)
+	if _, ok := err.(*RegistrationError); !ok {
+		if c != nil {
+			c.Close()
+		}
+		t.Fatalf("NewConnection() returned %v, want a RegistrationError", err)
+	}
+}
+
+func TestRegisterRefused(t *testing.T) {
+	config := newFakeServer(t, func(reply func(string), line string) bool {
+		if strings.HasPrefix(line, "NICK ") {
+			reply(":irc.example.com 464 * :Password incorrect")
+			return false
+		}
+		return true
+	}).config()
+	_, err := NewConnection(config)
+	if regErr, ok := err.(*RegistrationError); !ok || regErr.Numeric != "464" {
+		t.Fatalf("NewConnection() returned %v, want a 464 RegistrationError", err)
+	}
+}
+
+func TestRegisterPasswords(t *testing.T) {
+	lines := make(chan string, 100)
+	config := newFakeServer(t, func(reply func(string), line string) bool {
+		lines <- line
+		welcome(reply, line)
+		return true
+	}).config()
+	config.ServerPassword = "server secret"
+	config.NickServPassword = "nickserv secret"
+	c, err := NewConnection(config)
+	if err != nil {
+		t.Fatal("Registration failed:", err)
+	}
+	defer c.Close()
+
+	want := []string{"PASS :server secret", "PRIVMSG NickServ :IDENTIFY gomr nickserv secret"}
+	for len(want) > 0 {
+		select {
+		case line := <-lines:
+			if line == want[0] {
+				want = want[1:]
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q was never sent", want[0])
+		}
+	}
+}
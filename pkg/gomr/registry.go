@@ -0,0 +1,102 @@
+package gomr
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-gorp/gorp"
+	"github.com/golang/glog"
+)
+
+// PluginFactory builds a plugin from gomr's configuration and database
+type PluginFactory func(config *Config, db *gorp.DbMap) Plugin
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]PluginFactory)
+)
+
+// RegisterPlugin makes a plugin available to be enabled by name in the
+//   configuration, see Config.Plugins. Plugins call it from an init()
+//   function, with the name PluginName() gives the plugin.
+//   Registering the same name twice panics.
+func RegisterPlugin(name string, factory PluginFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	name = strings.ToLower(name)
+	if factory == nil {
+		panic("gomr: RegisterPlugin factory for " + name + " is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("gomr: RegisterPlugin called twice for " + name)
+	}
+	registry[name] = factory
+}
+
+// RegisteredPlugins returns the names of every plugin available, sorted
+func RegisteredPlugins() (names []string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the factory registered under name, if any
+func lookupPlugin(name string) (PluginFactory, bool) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	factory, ok := registry[strings.ToLower(name)]
+	return factory, ok
+}
+
+// Returns the configuration of the external plugin called name, if any
+func (c *Config) externalPlugin(name string) (ExternalPluginConfig, bool) {
+	for _, ext := range c.ExternalPlugins {
+		if strings.EqualFold(ext.Name, name) {
+			return ext, true
+		}
+	}
+	return ExternalPluginConfig{}, false
+}
+
+// Returns true if name is a registered or external plugin
+func (c *Config) pluginExists(name string) bool {
+	_, registered := lookupPlugin(name)
+	_, external := c.externalPlugin(name)
+	return registered || external
+}
+
+// Build the plugins enabled in config, all registered and external plugins
+//   if none are listed. Unknown names are skipped with a warning.
+func buildPlugins(config *Config, db *gorp.DbMap) (plugins []Plugin) {
+	available := RegisteredPlugins()
+	for _, ext := range config.ExternalPlugins {
+		available = append(available, ext.Name)
+	}
+	names := config.Plugins
+	if len(names) == 0 {
+		names = available
+	}
+
+	for _, name := range names {
+		if ext, ok := config.externalPlugin(name); ok {
+			plugins = append(plugins, NewExternalPlugin(ext, db))
+			continue
+		}
+		factory, ok := lookupPlugin(name)
+		if !ok {
+			glog.Infof("WARNING: No plugin named %q, available plugins are: %s", name, strings.Join(available, ", "))
+			continue
+		}
+		p := factory(config, db)
+		if PluginName(p) != strings.ToLower(name) {
+			glog.Infof("WARNING: Plugin %s is called %s in channel configurations", name, PluginName(p))
+		}
+		plugins = append(plugins, p)
+	}
+	return plugins
+}
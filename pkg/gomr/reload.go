@@ -0,0 +1,84 @@
+package gomr
+
+import (
+	"errors"
+	"io"
+
+	"github.com/golang/glog"
+)
+
+// Reload re-reads the configuration with Reloader and replaces the plugins
+//   with ones built from it. Channels added to the configuration are joined
+//   and those removed are left, without reconnecting. Settings used to
+//   connect, like the server, nick, TLS and SASL, take effect on the next
+//   reconnect, and the database and plugindir's existing plugins are kept.
+//   The old configuration is kept if the new one can't be used.
+func (s *GomrService) Reload() error {
+	if s.Reloader == nil {
+		return errors.New("There is no configuration to reload")
+	}
+	s.reloading.Lock()
+	defer s.reloading.Unlock()
+
+	config, err := s.Reloader()
+	if err != nil {
+		return err
+	}
+
+	plugins := registerPlugins(buildPlugins(config, s.Db))
+	sortPlugins(plugins, config.PluginOrder)
+	router, enabled, err := s.newRouter(plugins)
+	if err != nil {
+		closePlugins(plugins)
+		return err
+	}
+	plugins = enabled
+
+	s.mu.Lock()
+	old := s.Plugins
+	s.Config, s.Plugins, s.Router = config, plugins, router
+	conn := s.conn
+	s.mu.Unlock()
+
+	// Messages already being handled by the old plugins may fail
+	closePlugins(old)
+	if conn != nil {
+		conn.Reconfigure(config)
+	}
+	glog.Infoln("Reloaded the configuration")
+	return nil
+}
+
+// Admin command to Reload()
+func (s *GomrService) reload(ctx *Context, args []string) error {
+	if err := s.Reload(); err != nil {
+		ctx.Reply("Unable to reload the configuration: " + err.Error())
+		return err
+	}
+	ctx.Reply("Reloaded the configuration.")
+	return nil
+}
+
+// The current configuration and router, which Reload() may replace
+func (s *GomrService) config() *Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Config
+}
+
+func (s *GomrService) router() *Router {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Router
+}
+
+// Stop plugins that have something to stop, e.g. an ExternalPlugin's process
+func closePlugins(plugins []Plugin) {
+	for _, p := range plugins {
+		if c, ok := p.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				glog.Infof("ERROR: Unable to stop plugin %s: %s", PluginName(p), err)
+			}
+		}
+	}
+}
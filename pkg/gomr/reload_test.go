@@ -0,0 +1,79 @@
+package gomr
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-gorp/gorp"
+)
+
+// Make a plugin without commands available to enable as "reload"
+func registerReloadPlugin() {
+	if _, ok := lookupPlugin("reload"); ok {
+		return
+	}
+	RegisterPlugin("reload", func(config *Config, db *gorp.DbMap) Plugin {
+		return &commandPlugin{name: "reload"}
+	})
+}
+
+func TestReload(t *testing.T) {
+	registerReloadPlugin()
+	old := &Config{
+		Nick:     "gomr",
+		Channels: []ChannelConfig{{Name: "#a"}, {Name: "#b"}, {Name: "#keep"}},
+		Plugins:  []string{"reload"},
+	}
+	s := &GomrService{Config: old, Plugins: buildPlugins(old, nil)}
+	if err := s.RegisterPlugins(); err != nil {
+		t.Fatal("RegisterPlugins() returned an error:", err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Error("Reload() without a Reloader returned no error")
+	}
+
+	c, read := pipeConnection(t)
+	c.Reconfigure(old)
+	read(len(old.Channels))
+	s.conn = c
+
+	// Nothing is changed if the configuration can't be read
+	s.Reloader = func() (*Config, error) { return nil, errors.New("Unable to read the configuration") }
+	if err := s.Reload(); err == nil {
+		t.Error("Reload() returned no error when the Reloader failed")
+	}
+	if s.config() != old {
+		t.Error("The configuration was replaced when the Reloader failed")
+	}
+
+	next := &Config{
+		Nick: "gomr",
+		// #b is unchanged, only its case differs
+		Channels: []ChannelConfig{{Name: "#B"}, {Name: "#keep"}, {Name: "#c", Key: "secret"}},
+		Plugins:  []string{"reload"},
+		SendRate: 10,
+	}
+	s.Reloader = func() (*Config, error) { return next, nil }
+	before := s.Plugins[0]
+	if err := s.Reload(); err != nil {
+		t.Fatal("Reload() returned an error:", err)
+	}
+
+	lines := read(2)
+	if lines[0] != "JOIN #c secret\r\n" || lines[1] != "PART #a\r\n" {
+		t.Errorf("Sent %q on reload, want to join #c and part #a", lines)
+	}
+	if s.config() != next || c.settings() != next {
+		t.Error("The configuration wasn't replaced")
+	}
+
+	if len(s.Plugins) != 1 || s.Plugins[0] == before {
+		t.Fatalf("The plugins weren't rebuilt: %v", s.Plugins)
+	}
+	if !before.(*commandPlugin).closed {
+		t.Error("The old plugin wasn't closed")
+	}
+	if s.Plugins[0].(*commandPlugin).closed {
+		t.Error("The new plugin was closed")
+	}
+}
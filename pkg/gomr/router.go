@@ -0,0 +1,209 @@
+package gomr
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Command is a named command a plugin answers when addressed, e.g.
+//   "gomr: rank tim", "!rank tim", or "rank tim" in a private message.
+//   Plugins with commands implement Commander, and the Router takes care of
+//   matching them, checking their arguments and listing them in help.
+type Command struct {
+	// One or more words, matched case insensitively, e.g. "karma merge"
+	Name string
+
+	// The arguments, e.g. "<fact> [n]". <required> and [optional] arguments
+	//   are single words, the last may be "<text...>" or "[text...]" to take
+	//   the rest of the line.
+	Args string
+
+	Help  string
+	Admin bool // Only admins may use it, see Transport.IsAdmin()
+
+	// Called with one argument per word of Args, optional arguments that
+	//   were left out are empty
+	Run func(ctx *Context, args []string) error
+}
+
+// Plugins with commands implement this, see Command
+type Commander interface {
+	Commands() []Command
+}
+
+// Router dispatches commands to the plugins they belong to
+type Router struct {
+	routes []*route
+}
+
+type route struct {
+	Command
+	plugin string // Name of the plugin, empty for gomr's own commands
+
+	words    []string
+	required int
+	optional int
+	rest     bool
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Add the commands of the named plugin. The plugin name is used to check
+//   whether it is enabled in a channel, see ChannelConfig.PluginEnabled()
+//   If any of the commands can't be added, none of them are.
+func (r *Router) Add(plugin string, commands ...Command) error {
+	routes := r.routes
+	for _, cmd := range commands {
+		rt := &route{Command: cmd, plugin: plugin, words: strings.Fields(strings.ToLower(cmd.Name))}
+		if len(rt.words) == 0 || cmd.Run == nil {
+			return errors.New("Command must have a name and a Run function: " + cmd.Name)
+		}
+		if err := rt.parseArgs(); err != nil {
+			return err
+		}
+		for _, other := range routes {
+			if strings.Join(other.words, " ") == strings.Join(rt.words, " ") {
+				return errors.New("Command " + cmd.Name + " is already defined")
+			}
+		}
+		routes = append(routes[:len(routes):len(routes)], rt)
+	}
+	r.routes = routes
+
+	// Try longer names first, so "karma merge" wins over "karma"
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return len(r.routes[i].words) > len(r.routes[j].words)
+	})
+	return nil
+}
+
+// Route runs the command the context's message asks for, if it was
+//   addressed to us and the command's plugin is enabled. Returns true if
+//   the message was a command, whether or not it succeeded.
+func (r *Router) Route(ctx *Context, enabled map[string]bool) bool {
+	if ctx.Command != "PRIVMSG" || !ctx.Addressed {
+		return false
+	}
+	words := strings.Fields(ctx.Stripped)
+
+	for _, rt := range r.routes {
+		if rt.plugin != "" && !enabled[rt.plugin] {
+			continue
+		}
+		args, ok := rt.match(words)
+		if !ok {
+			continue
+		}
+
+		if args == nil {
+			ctx.Reply("Usage: " + rt.usage(ctx.Transport.Nick()))
+			return true
+		}
+		if rt.Admin && !ctx.Transport.IsAdmin(ctx.Sender) {
+			ctx.Reply("Only admins can use " + rt.Name + " " + ctx.Sender + ".")
+			return true
+		}
+		err := rt.Run(ctx, args)
+		if err != nil {
+			glog.Infoln("ERROR in command", rt.Name, ":", err)
+		}
+		return true
+	}
+	return false
+}
+
+// Help returns a line describing each of the named plugin's commands.
+//   An empty plugin name returns gomr's own commands.
+func (r *Router) Help(plugin, nick string) (texts []string) {
+	for _, rt := range r.routes {
+		if rt.plugin != plugin {
+			continue
+		}
+		text := rt.usage(nick)
+		if rt.Help != "" {
+			text += " - " + rt.Help
+		}
+		if rt.Admin {
+			text += " (admins only)"
+		}
+		texts = append(texts, text)
+	}
+	sort.Strings(texts)
+	return texts
+}
+
+// Check the argument spec, e.g. "<fact> [n]"
+func (rt *route) parseArgs() error {
+	args := strings.Fields(rt.Args)
+	for i, arg := range args {
+		optional := strings.HasPrefix(arg, "[") && strings.HasSuffix(arg, "]")
+		required := strings.HasPrefix(arg, "<") && strings.HasSuffix(arg, ">")
+		switch {
+		case !optional && !required:
+			return errors.New("Command " + rt.Name + " argument " + arg + " must be <required> or [optional]")
+		case required && rt.optional > 0:
+			return errors.New("Command " + rt.Name + " has a required argument after an optional one")
+		case required:
+			rt.required++
+		default:
+			rt.optional++
+		}
+		if strings.HasSuffix(arg[1:len(arg)-1], "...") {
+			if i != len(args)-1 {
+				return errors.New("Command " + rt.Name + " may only take the rest of the line as its last argument")
+			}
+			rt.rest = true
+		}
+	}
+	return nil
+}
+
+// Returns true if words start with the command's name, along with the
+//   arguments. The arguments are nil if some are missing. Words with more
+//   arguments than the command takes aren't a match, so "gomr: rank is
+//   fun" is left to the plugins.
+func (rt *route) match(words []string) ([]string, bool) {
+	if len(words) < len(rt.words) {
+		return nil, false
+	}
+	for i, w := range rt.words {
+		// Allow "define: word", as people are used to addressing with a colon
+		if strings.TrimRight(strings.ToLower(words[i]), ":") != w {
+			return nil, false
+		}
+	}
+
+	given := words[len(rt.words):]
+	total := rt.required + rt.optional
+	if len(given) > total && !rt.rest {
+		return nil, false
+	}
+	if len(given) < rt.required {
+		return nil, true
+	}
+
+	args := make([]string, total)
+	for i := range args {
+		switch {
+		case i >= len(given):
+		case i == total-1 && rt.rest:
+			args[i] = strings.Join(given[i:], " ")
+		default:
+			args[i] = given[i]
+		}
+	}
+	return args, true
+}
+
+func (rt *route) usage(nick string) string {
+	text := nick + "[:] " + rt.Name
+	if rt.Args != "" {
+		text += " " + rt.Args
+	}
+	return text
+}
@@ -0,0 +1,51 @@
+package gomr
+
+import (
+	"strings"
+)
+
+// Characters that would end a line sent to the server early, letting whoever
+//   controls the text (a factoid definition, a nick, an api response...) send
+//   any command they like after it.
+const lineBreakers = "\r\n\x00"
+
+// The character CTCP messages are wrapped in, text containing it could send
+//   a CTCP request (an ACTION, a DCC offer...) rather than text.
+const ctcpDelimiter = "\x01"
+
+// Replace line breaks in text with spaces, and drop NUL and CTCP delimiter
+//   characters, so text can be safely sent as part of a single line.
+func sanitizeText(text string) string {
+	if !strings.ContainsAny(text, lineBreakers+ctcpDelimiter) {
+		return text
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '\r', '\n':
+			return ' '
+		case '\x00', '\x01':
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// Strip anything that would end a raw line early
+func sanitizeLine(line string) string {
+	if !strings.ContainsAny(line, lineBreakers) {
+		return line
+	}
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(lineBreakers, r) {
+			return -1
+		}
+		return r
+	}, line)
+}
+
+// ValidTarget returns true if target can be used as the nick or channel a
+//   message is sent to, that is, it is a single parameter that can't be
+//   mistaken for the text of the message.
+func ValidTarget(target string) bool {
+	return target != "" && target[0] != ':' && !strings.ContainsAny(target, " ,"+lineBreakers)
+}
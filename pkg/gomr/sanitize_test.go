@@ -0,0 +1,130 @@
+package gomr
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A Connection writing to a net.Pipe, along with a function returning the
+//   next n lines written to it. It fails the test if more lines follow.
+func pipeConnection(t *testing.T) (*Connection, func(n int) []string) {
+	client, server := net.Pipe()
+	c := newConnection(client, &Config{Nick: "gomr", SendBurst: 100, SendRate: 100})
+	t.Cleanup(func() { c.Close() })
+
+	written := make(chan string, 100)
+	go func() {
+		r := bufio.NewReader(server)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			written <- line
+		}
+	}()
+
+	read := func(n int) (lines []string) {
+		for len(lines) < n {
+			select {
+			case line := <-written:
+				lines = append(lines, line)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Only %d of %d lines were written: %q", len(lines), n, lines)
+			}
+		}
+		select {
+		case line := <-written:
+			t.Fatalf("Unexpected line written after %q: %q", lines, line)
+		case <-time.After(100 * time.Millisecond):
+		}
+		return lines
+	}
+	return c, read
+}
+
+func TestInjectedLinesNeverSent(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(c *Connection)
+		want []string
+	}{
+		{
+			name: "factoid text",
+			send: func(c *Connection) { c.SendTo("#a", "foo is bar\r\nQUIT :pwned") },
+			want: []string{"PRIVMSG #a :foo is bar  QUIT :pwned\r\n"},
+		},
+		{
+			name: "private message text",
+			send: func(c *Connection) { c.SendPrivate("tim", "foo\nQUIT\x00") },
+			want: []string{"PRIVMSG tim :foo QUIT\r\n"},
+		},
+		{
+			name: "action text",
+			send: func(c *Connection) { c.SendAction("#a", "waves\r\nQUIT") },
+			want: []string{"PRIVMSG #a :\x01ACTION waves  QUIT\x01\r\n"},
+		},
+		{
+			name: "CTCP in text",
+			send: func(c *Connection) { c.SendTo("#a", "\x01DCC SEND evil 2130706433 6667\x01") },
+			want: []string{"PRIVMSG #a :DCC SEND evil 2130706433 6667\r\n"},
+		},
+		{
+			name: "target",
+			send: func(c *Connection) { c.SendTo("#a\r\nQUIT", "hi") },
+		},
+		{
+			name: "target with text",
+			send: func(c *Connection) { c.SendTo("#a :hi", "hi") },
+		},
+		{
+			name: "action target",
+			send: func(c *Connection) { c.SendAction("#a\nQUIT", "waves") },
+		},
+		{
+			name: "channel name",
+			send: func(c *Connection) { c.Join(ChannelConfig{Name: "#b\r\nQUIT"}) },
+		},
+		{
+			name: "channel key",
+			send: func(c *Connection) { c.Join(ChannelConfig{Name: "#b", Key: "key\r\nQUIT"}) },
+		},
+		{
+			name: "raw line",
+			send: func(c *Connection) { c.Send("PONG :irc.example.com\r\nQUIT") },
+			want: []string{"PONG :irc.example.comQUIT\r\n"},
+		},
+		{
+			name: "queued line",
+			send: func(c *Connection) { c.queue.push("#a", "PRIVMSG #a :hi\nQUIT") },
+			want: []string{"PRIVMSG #a :hiQUIT\r\n"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, read := pipeConnection(t)
+			test.send(c)
+			lines := read(len(test.want))
+			for i := range test.want {
+				if lines[i] != test.want[i] {
+					t.Errorf("Line %d written is %q, want %q", i, lines[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+// Text split over several lines must not start a new command at a line break
+func TestInjectedLinesNeverSentWhenSplit(t *testing.T) {
+	c, read := pipeConnection(t)
+	c.SendTo("#a", strings.Repeat("a", 300)+"\r\nQUIT :pwned "+strings.Repeat("b", 300))
+	for _, line := range read(2) {
+		if !strings.HasPrefix(line, "PRIVMSG #a :") || strings.Count(line, "\r\n") != 1 || !strings.HasSuffix(line, "\r\n") {
+			t.Errorf("Unexpected line written: %q", line)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package gomr
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// SASL mechanisms supported when authenticating with the server
+const (
+	SASLPlain    = "PLAIN"
+	SASLExternal = "EXTERNAL"
+)
+
+// AUTHENTICATE payloads are sent in chunks of at most this many bytes
+const saslChunkSize = 400
+
+// The base64 encoded response to the server's AUTHENTICATE challenge.
+//   EXTERNAL uses the TLS client certificate, so has an empty response.
+func saslPayload(config *Config) string {
+	if strings.ToUpper(config.SASLMechanism) != SASLPlain {
+		return ""
+	}
+	user := config.SASLUsername
+	if user == "" {
+		user = config.Nick
+	}
+	return base64.StdEncoding.EncodeToString([]byte(user + "\x00" + user + "\x00" + config.SASLPassword))
+}
+
+// Send a base64 encoded payload, split into chunks as required by the spec.
+//   An empty payload (or one that is an exact multiple of the chunk size)
+//   is terminated with "+".
+func (c *Connection) sendAuthenticate(payload string) {
+	for len(payload) >= saslChunkSize {
+		c.Send("AUTHENTICATE " + payload[:saslChunkSize])
+		payload = payload[saslChunkSize:]
+	}
+	if payload == "" {
+		payload = "+"
+	}
+	c.Send("AUTHENTICATE " + payload)
+}
+
+// Check the capabilities from CAP LS for sasl support of the given mechanism.
+//   CAP LS 302 may list the supported mechanisms as "sasl=PLAIN,EXTERNAL".
+func saslSupports(caps []string, mechanism string) bool {
+	for _, c := range caps {
+		if c == "sasl" {
+			return true
+		}
+		if strings.HasPrefix(c, "sasl=") {
+			for _, m := range strings.Split(c[len("sasl="):], ",") {
+				if strings.ToUpper(m) == mechanism {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
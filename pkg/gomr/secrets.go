@@ -0,0 +1,65 @@
+package gomr
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Secrets in configuration may reference a file or an environment variable
+//   instead of being written out, so they don't show up in ps or the config:
+//   "file:/run/secrets/irc-password" reads the (first line of the) file,
+//   "env:IRC_PASSWORD" reads the environment variable.
+//   Any other value is used as is.
+const (
+	secretFilePrefix = "file:"
+	secretEnvPrefix  = "env:"
+)
+
+// ReadSecret resolves a secret configuration value, see secretFilePrefix
+func ReadSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretFilePrefix):
+		path := value[len(secretFilePrefix):]
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", errors.New("Unable to read secret from file: " + err.Error())
+		}
+		return strings.SplitN(strings.TrimRight(string(contents), "\r\n"), "\n", 2)[0], nil
+
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := value[len(secretEnvPrefix):]
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.New("Unable to read secret from environment: " + name + " is not set")
+		}
+		return secret, nil
+	}
+	return value, nil
+}
+
+// ReadSecrets resolves every secret in the configuration in place
+func (c *Config) ReadSecrets() (err error) {
+	secrets := []*string{&c.ServerPassword, &c.NickServPassword, &c.SASLPassword, &c.WordnikAPIKey}
+	for i := range c.Channels {
+		secrets = append(secrets, &c.Channels[i].Key)
+	}
+	return readSecrets(secrets)
+}
+
+// ReadSecrets resolves every secret in the database configuration in place
+func (d *DbConfig) ReadSecrets() (err error) {
+	return readSecrets([]*string{&d.Password})
+}
+
+func readSecrets(secrets []*string) error {
+	for _, s := range secrets {
+		value, err := ReadSecret(*s)
+		if err != nil {
+			return err
+		}
+		*s = value
+	}
+	return nil
+}
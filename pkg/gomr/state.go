@@ -0,0 +1,396 @@
+package gomr
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Channel modes assumed until the server tells us its own in RPL_ISUPPORT
+const (
+	defaultPrefix    = "(ov)@+"
+	defaultChanModes = "beI,k,l,imnpst"
+)
+
+// User is what we know about someone sharing a channel with us
+type User struct {
+	Nick    string
+	User    string
+	Host    string
+	Account string // Empty if they are not logged in, or the server doesn't tell us
+}
+
+// Member is a user in a channel, along with their channel modes, e.g. "ov"
+type Member struct {
+	User
+	Modes string
+}
+
+// Returns true if the member is a channel operator (or above, on servers
+//   with founder and admin modes)
+func (m Member) IsOp() bool {
+	return strings.ContainsAny(m.Modes, "qao")
+}
+
+// Returns true if the member has voice, or any mode above it
+func (m Member) IsVoiced() bool {
+	return m.Modes != ""
+}
+
+// State keeps track of the channels we are in and who is in them, from the
+//   NAMES, JOIN, PART, QUIT, KICK, NICK and MODE messages the server sends.
+//   Users are only tracked while they share a channel with us.
+type State struct {
+	mu       sync.RWMutex
+	users    map[string]*User         // By canonical nick
+	channels map[string]*channelState // By canonical channel name
+
+	// From RPL_ISUPPORT: the modes shown as prefixes on nicks in NAMES (and
+	//   their prefixes), and the other channel modes grouped by how they
+	//   take parameters.
+	prefixModes string
+	prefixChars string
+	chanModes   []string
+	whox        bool // The server supports WHOX, see Connection.updateAccounts()
+}
+
+type channelState struct {
+	name    string
+	members map[string]string // Modes, by canonical nick
+}
+
+func newState() *State {
+	s := &State{
+		users:    make(map[string]*User),
+		channels: make(map[string]*channelState),
+	}
+	s.setPrefix(defaultPrefix)
+	s.chanModes = strings.Split(defaultChanModes, ",")
+	return s
+}
+
+// Channels returns the names of the channels we are in
+func (s *State) Channels() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var names []string
+	for _, ch := range s.channels {
+		names = append(names, ch.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Members returns everyone in the channel, sorted by nick. Returns nil if we
+//   are not in the channel.
+func (s *State) Members(channel string) []Member {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ch := s.channels[CanonicalizeIrcNick(channel)]
+	if ch == nil {
+		return nil
+	}
+	var members []Member
+	for key, modes := range ch.members {
+		members = append(members, Member{User: *s.users[key], Modes: modes})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return CanonicalizeIrcNick(members[i].Nick) < CanonicalizeIrcNick(members[j].Nick)
+	})
+	return members
+}
+
+// Member returns nick's membership of the channel. False is returned if they
+//   (or we) are not in it.
+func (s *State) Member(channel, nick string) (Member, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ch := s.channels[CanonicalizeIrcNick(channel)]
+	if ch == nil {
+		return Member{}, false
+	}
+	key := CanonicalizeIrcNick(nick)
+	modes, ok := ch.members[key]
+	if !ok {
+		return Member{}, false
+	}
+	return Member{User: *s.users[key], Modes: modes}, true
+}
+
+// Returns true if nick is in the channel
+func (s *State) InChannel(channel, nick string) bool {
+	_, ok := s.Member(channel, nick)
+	return ok
+}
+
+// User returns what we know about nick. False is returned if they don't
+//   share a channel with us.
+func (s *State) User(nick string) (User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u := s.users[CanonicalizeIrcNick(nick)]
+	if u == nil {
+		return User{}, false
+	}
+	return *u, true
+}
+
+// Update the state from a message sent by the server. isMe reports whether
+//   a nick is our own.
+func (s *State) update(msg *Message, isMe func(string) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Any message tells us the sender's current user and host, and with the
+	//   account-tag capability, their account
+	if u := s.users[CanonicalizeIrcNick(msg.Nick)]; u != nil {
+		if msg.User != "" && msg.Host != "" {
+			u.User, u.Host = msg.User, msg.Host
+		}
+		if name, ok := msg.Tags["account"]; ok {
+			u.Account = name
+		}
+	}
+
+	switch msg.Command {
+	case "005":
+		// RPL_ISUPPORT, the first parameter is our nick and the last is a description
+		for i := 1; i < len(msg.Params)-1; i++ {
+			s.isupport(msg.Params[i])
+		}
+
+	case "353":
+		// RPL_NAMREPLY, the members of a channel we joined
+		ch := s.channels[CanonicalizeIrcNick(msg.Param(2))]
+		if ch == nil {
+			return
+		}
+		for _, name := range strings.Fields(msg.Trailing()) {
+			var modes string
+			for name != "" && strings.IndexByte(s.prefixChars, name[0]) >= 0 {
+				modes = s.setMode(modes, s.prefixModes[strings.IndexByte(s.prefixChars, name[0])], true)
+				name = name[1:]
+			}
+			// With userhost-in-names, names are full nick!user@host masks
+			nick, user, host := splitPrefix(name)
+			s.addMember(ch, nick, user, host)
+			ch.members[CanonicalizeIrcNick(nick)] = modes
+		}
+
+	case "JOIN":
+		key := CanonicalizeIrcNick(msg.Param(0))
+		if isMe(msg.Nick) {
+			s.channels[key] = &channelState{name: msg.Param(0), members: make(map[string]string)}
+		}
+		ch := s.channels[key]
+		if ch == nil {
+			return
+		}
+		u := s.addMember(ch, msg.Nick, msg.User, msg.Host)
+		// With extended-join, the account name (or "*") follows the channel
+		if len(msg.Params) > 2 {
+			u.Account = account(msg.Param(1))
+		}
+
+	case "PART":
+		s.leave(msg.Param(0), msg.Nick, isMe(msg.Nick))
+
+	case "KICK":
+		s.leave(msg.Param(0), msg.Param(1), isMe(msg.Param(1)))
+
+	case "QUIT":
+		key := CanonicalizeIrcNick(msg.Nick)
+		for _, ch := range s.channels {
+			delete(ch.members, key)
+		}
+		delete(s.users, key)
+
+	case "NICK":
+		oldKey, newKey := CanonicalizeIrcNick(msg.Nick), CanonicalizeIrcNick(msg.Trailing())
+		u := s.users[oldKey]
+		if u == nil {
+			return
+		}
+		u.Nick = msg.Trailing()
+		delete(s.users, oldKey)
+		s.users[newKey] = u
+		for _, ch := range s.channels {
+			if modes, ok := ch.members[oldKey]; ok {
+				delete(ch.members, oldKey)
+				ch.members[newKey] = modes
+			}
+		}
+
+	case "MODE":
+		ch := s.channels[CanonicalizeIrcNick(msg.Param(0))]
+		if ch != nil && len(msg.Params) > 1 {
+			s.updateModes(ch, msg.Param(1), msg.Params[2:])
+		}
+
+	case "ACCOUNT":
+		// account-notify, the account name or "*" when they log out
+		if u := s.users[CanonicalizeIrcNick(msg.Nick)]; u != nil {
+			u.Account = account(msg.Param(0))
+		}
+
+	case "CHGHOST":
+		if u := s.users[CanonicalizeIrcNick(msg.Nick)]; u != nil {
+			u.User, u.Host = msg.Param(0), msg.Param(1)
+		}
+
+	case "354":
+		// RPL_WHOSPCRPL, our WHOX reply: me token channel user host nick flags account
+		if msg.Param(1) != whoxToken {
+			return
+		}
+		if u := s.users[CanonicalizeIrcNick(msg.Param(5))]; u != nil {
+			u.User, u.Host = msg.Param(3), msg.Param(4)
+			u.Account = msg.Param(7)
+			if u.Account == "0" {
+				u.Account = ""
+			}
+		}
+	}
+}
+
+// Add nick to the channel with no modes, if they are not already in it
+func (s *State) addMember(ch *channelState, nick, user, host string) *User {
+	key := CanonicalizeIrcNick(nick)
+	u := s.users[key]
+	if u == nil {
+		u = &User{Nick: nick}
+		s.users[key] = u
+	}
+	if user != "" && host != "" {
+		u.User, u.Host = user, host
+	}
+	if _, ok := ch.members[key]; !ok {
+		ch.members[key] = ""
+	}
+	return u
+}
+
+// Remove nick from the channel, or forget the channel if it was us leaving
+func (s *State) leave(channel, nick string, me bool) {
+	key := CanonicalizeIrcNick(channel)
+	ch := s.channels[key]
+	if ch == nil {
+		return
+	}
+
+	var gone []string
+	if me {
+		delete(s.channels, key)
+		for member := range ch.members {
+			gone = append(gone, member)
+		}
+	} else {
+		member := CanonicalizeIrcNick(nick)
+		delete(ch.members, member)
+		gone = append(gone, member)
+	}
+
+	// Forget anyone we no longer share a channel with
+	for _, member := range gone {
+		shared := false
+		for _, other := range s.channels {
+			if _, ok := other.members[member]; ok {
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			delete(s.users, member)
+		}
+	}
+}
+
+// Apply a channel MODE change, e.g. "+ov-b nick nick mask"
+func (s *State) updateModes(ch *channelState, modes string, args []string) {
+	adding := true
+	for i := 0; i < len(modes); i++ {
+		mode := modes[i]
+		switch {
+		case mode == '+':
+			adding = true
+		case mode == '-':
+			adding = false
+		case strings.IndexByte(s.prefixModes, mode) >= 0:
+			if len(args) == 0 {
+				return
+			}
+			key := CanonicalizeIrcNick(args[0])
+			args = args[1:]
+			if current, ok := ch.members[key]; ok {
+				ch.members[key] = s.setMode(current, mode, adding)
+			}
+		case s.modeTakesParam(mode, adding):
+			if len(args) == 0 {
+				return
+			}
+			args = args[1:]
+		}
+	}
+}
+
+// Returns true if setting (or unsetting) the channel mode takes a parameter.
+//   CHANMODES lists modes that always take one, modes that always take one,
+//   modes that only take one when set, and modes that never do.
+func (s *State) modeTakesParam(mode byte, adding bool) bool {
+	for i, group := range s.chanModes {
+		if strings.IndexByte(group, mode) < 0 {
+			continue
+		}
+		return i < 2 || (i == 2 && adding)
+	}
+	return false
+}
+
+// Add or remove a prefix mode, keeping modes in order of rank
+func (s *State) setMode(modes string, mode byte, adding bool) string {
+	var result []byte
+	for i := 0; i < len(s.prefixModes); i++ {
+		m := s.prefixModes[i]
+		if m == mode {
+			if adding {
+				result = append(result, m)
+			}
+		} else if strings.IndexByte(modes, m) >= 0 {
+			result = append(result, m)
+		}
+	}
+	return string(result)
+}
+
+// Parse a single RPL_ISUPPORT token that affects the state
+func (s *State) isupport(token string) {
+	switch {
+	case strings.HasPrefix(token, "PREFIX="):
+		s.setPrefix(token[len("PREFIX="):])
+	case strings.HasPrefix(token, "CHANMODES="):
+		s.chanModes = strings.Split(token[len("CHANMODES="):], ",")
+	case token == "WHOX":
+		s.whox = true
+	}
+}
+
+// Set the prefix modes from a PREFIX value, e.g. "(qaohv)~&@%+"
+func (s *State) setPrefix(value string) {
+	end := strings.IndexByte(value, ')')
+	if !strings.HasPrefix(value, "(") || end < 0 || len(value[1:end]) != len(value[end+1:]) {
+		return
+	}
+	s.prefixModes, s.prefixChars = value[1:end], value[end+1:]
+}
+
+// The account from extended-join or account-notify, "*" means none
+func account(name string) string {
+	if name == "*" {
+		return ""
+	}
+	return name
+}
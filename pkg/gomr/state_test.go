@@ -0,0 +1,107 @@
+package gomr
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The modes of each member of channel, by nick
+func memberModes(s *State, channel string) map[string]string {
+	modes := make(map[string]string)
+	for _, m := range s.Members(channel) {
+		modes[m.Nick] = m.Modes
+	}
+	return modes
+}
+
+func TestStateNames(t *testing.T) {
+	c, _ := pipeConnection(t)
+	receive(t, c,
+		":irc.example.com 005 gomr PREFIX=(qaohv)~&@%+ CHANMODES=beI,k,l,imnpst :are supported by this server",
+		":gomr!~gomr@example.com JOIN #test",
+		// multi-prefix and userhost-in-names
+		":irc.example.com 353 gomr = #test :gomr +@alice!~alice@alice.example.com %bob ~carol",
+	)
+
+	want := map[string]string{"gomr": "", "alice": "ov", "bob": "h", "carol": "q"}
+	if got := memberModes(c.State, "#TEST"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Members after NAMES are %q, want %q", got, want)
+	}
+	if u, _ := c.State.User("Alice"); u.User != "~alice" || u.Host != "alice.example.com" {
+		t.Errorf("User(alice) = %+v, want the user and host from NAMES", u)
+	}
+	if m, _ := c.State.Member("#test", "alice"); !m.IsOp() {
+		t.Error("alice is not an op")
+	}
+	if m, _ := c.State.Member("#test", "bob"); m.IsOp() {
+		t.Error("bob, a halfop, is an op")
+	}
+}
+
+func TestStateModes(t *testing.T) {
+	c, _ := pipeConnection(t)
+	receive(t, c,
+		":irc.example.com 005 gomr PREFIX=(ov)@+ CHANMODES=beI,k,l,imnpst :are supported by this server",
+		":gomr!~gomr@example.com JOIN #test",
+		":irc.example.com 353 gomr = #test :gomr alice @bob +carol",
+		// Modes taking parameters must be skipped to find whose the next one is:
+		//   b always takes one, k always, l only when set, n never
+		":chanserv!~chanserv@services MODE #test +bonk *!*@spam.example.com alice key",
+		":chanserv!~chanserv@services MODE #test -v+l-lo carol 10 bob",
+		":chanserv!~chanserv@services MODE #test -k+v key alice",
+		// Not a member, and a channel we are not in
+		":chanserv!~chanserv@services MODE #test +o dave",
+		":chanserv!~chanserv@services MODE #other +o carol",
+	)
+
+	want := map[string]string{"gomr": "", "alice": "ov", "bob": "", "carol": ""}
+	if got := memberModes(c.State, "#test"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Members after MODE are %q, want %q", got, want)
+	}
+}
+
+func TestStateChanges(t *testing.T) {
+	c, _ := pipeConnection(t)
+	receive(t, c,
+		":gomr!~gomr@example.com JOIN #test",
+		":irc.example.com 353 gomr = #test :gomr @alice bob carol dave",
+		":gomr!~gomr@example.com JOIN #other",
+		":irc.example.com 353 gomr = #other :gomr alice",
+		":alice!~alice@alice.example.com NICK :alicia",
+		":bob!~bob@bob.example.com PART #test :bye",
+		":alicia!~alice@alice.example.com KICK #test carol :out",
+		":dave!~dave@dave.example.com QUIT :gone",
+	)
+
+	want := map[string]string{"gomr": "", "alicia": "o"}
+	if got := memberModes(c.State, "#test"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Members of #test are %q, want %q", got, want)
+	}
+	for _, nick := range []string{"alice", "bob", "carol", "dave"} {
+		if _, ok := c.State.User(nick); ok {
+			t.Errorf("%s is still known", nick)
+		}
+	}
+	if u, ok := c.State.User("alicia"); !ok || u.Nick != "alicia" || u.Host != "alice.example.com" {
+		t.Errorf("User(alicia) = %+v, %v", u, ok)
+	}
+	if !c.State.InChannel("#other", "alicia") {
+		t.Error("alicia's rename wasn't applied to #other")
+	}
+
+	// Leaving a channel forgets whoever we only shared it with
+	receive(t, c, ":alicia!~alice@alice.example.com KICK #other gomr :out")
+	if got := c.State.Channels(); len(got) != 1 || got[0] != "#test" {
+		t.Errorf("Channels() = %q after being kicked from #other", got)
+	}
+	if _, ok := c.State.User("alicia"); !ok {
+		t.Error("alicia is forgotten while still in #test")
+	}
+	receive(t, c, ":gomr!~gomr@example.com PART #test")
+	if got := c.State.Channels(); len(got) != 0 {
+		t.Errorf("Channels() = %q after leaving every channel", got)
+	}
+	if _, ok := c.State.User("alicia"); ok {
+		t.Error("alicia is still known after leaving every channel")
+	}
+}
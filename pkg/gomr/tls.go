@@ -0,0 +1,57 @@
+package gomr
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+
+	"github.com/golang/glog"
+)
+
+// TLSConfig builds the tls configuration used to connect to the irc server.
+//   The system root certificates are always trusted, TLSCAFile adds to them.
+//   TLSCertFile (and TLSKeyFile, if the key is not in the same file) provide
+//   a client certificate, used by many networks for CertFP authentication.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: c.Hostname,
+	}
+
+	if c.TLSInsecureSkipVerify {
+		glog.Infoln("WARNING: TLS certificate verification is disabled, the connection to", c.Hostname, "is not secure")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if c.TLSCAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			glog.Infoln("Unable to load system root certificates, only trusting", c.TLSCAFile, ":", err)
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, errors.New("Unable to read TLS CA file: " + err.Error())
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in TLS CA file " + c.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.TLSCertFile != "" {
+		keyFile := c.TLSKeyFile
+		if keyFile == "" {
+			keyFile = c.TLSCertFile
+		}
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, keyFile)
+		if err != nil {
+			return nil, errors.New("Unable to load TLS client certificate: " + err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else if c.TLSKeyFile != "" {
+		return nil, errors.New("A TLS key file was provided without a TLS certificate file")
+	}
+
+	return tlsConfig, nil
+}
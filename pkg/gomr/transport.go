@@ -0,0 +1,92 @@
+package gomr
+
+import (
+	"github.com/golang/glog"
+)
+
+// Transport is how plugins talk to the chat network, so they don't need to
+//   know whether it is IRC or something else. Connection is the IRC
+//   transport, Console reads and writes a terminal.
+type Transport interface {
+	// Our current nick, and whether nick is ours
+	Nick() string
+	IsMe(nick string) bool
+
+	// Returns true if name is a channel rather than a user
+	IsChannel(name string) bool
+
+	// The name records about a user should be kept under, which may differ
+	//   from their current nick. See State.Identity()
+	Identity(nick string) string
+
+	// The account nick is logged in to, or empty if they aren't or we don't know
+	Account(nick string) string
+
+	// Returns true if nick may use admin commands
+	IsAdmin(nick string) bool
+
+	// Everyone in a channel we are in, sorted by nick, and whether nick is
+	//   in it. See State.Members()
+	Members(channel string) []Member
+	InChannel(channel, nick string) bool
+
+	// Send a message to a channel or user. SendPrivate always sends to the
+	//   user, even on networks where replies to them would go to a channel.
+	SendTo(target, text string)
+	SendPrivate(nick, text string)
+
+	// Send an action, e.g. "/me waves"
+	SendAction(target, text string)
+
+	// Send the rest of the last message too long to send at once. Returns
+	//   false if there was nothing more to send.
+	More(target string) bool
+}
+
+// The CTCP ACTION markers an action's text is wrapped in
+const (
+	actionStart = ctcpDelimiter + "ACTION "
+	actionEnd   = ctcpDelimiter
+)
+
+// Returns true if name is a channel rather than a nick
+func (c *Connection) IsChannel(name string) bool {
+	return IsChannel(name)
+}
+
+// Identity returns the account of the user if known, see State.Identity()
+func (c *Connection) Identity(nick string) string {
+	return c.State.Identity(nick)
+}
+
+// Members returns everyone in the channel, see State.Members()
+func (c *Connection) Members(channel string) []Member {
+	return c.State.Members(channel)
+}
+
+// Returns true if nick is in the channel, see State.InChannel()
+func (c *Connection) InChannel(channel, nick string) bool {
+	return c.State.InChannel(channel, nick)
+}
+
+// Send a private message to nick
+func (c *Connection) SendPrivate(nick, text string) {
+	if IsChannel(nick) {
+		glog.Infof("ERROR: Refusing to send a private message to channel %q: %s", nick, sanitizeText(text))
+		return
+	}
+	c.SendTo(nick, text)
+}
+
+// Send an action as a CTCP ACTION. Actions too long for a single line are
+//   split, but never held back for More().
+func (c *Connection) SendAction(target, text string) {
+	if !ValidTarget(target) {
+		glog.Infof("ERROR: Refusing to send to invalid target %q: %s", target, sanitizeText(text))
+		return
+	}
+	max := c.maxTextLength("PRIVMSG", target) - len(actionStart+actionEnd)
+	for _, line := range splitText(sanitizeText(text), max) {
+		c.queue.push(target, "PRIVMSG "+target+" :"+actionStart+line+actionEnd)
+	}
+}
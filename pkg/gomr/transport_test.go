@@ -0,0 +1,35 @@
+package gomr
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Plugins see who is in a channel the same way on every transport
+func TestTransportMembers(t *testing.T) {
+	c, _ := pipeConnection(t)
+	receive(t, c,
+		":gomr!gomr@example.com JOIN #test",
+		":irc.example.com 353 gomr = #test :gomr @tim",
+	)
+	console := &Console{BotNick: "gomr", User: "tim", Channel: "#test"}
+
+	for _, transport := range []Transport{c, console} {
+		var nicks []string
+		for _, m := range transport.Members("#TEST") {
+			nicks = append(nicks, m.Nick)
+		}
+		if want := []string{"gomr", "tim"}; !reflect.DeepEqual(nicks, want) {
+			t.Errorf("%T.Members() = %q, want %q", transport, nicks, want)
+		}
+		if !transport.InChannel("#test", "Tim") {
+			t.Errorf("%T.InChannel() = false for a member", transport)
+		}
+		if transport.InChannel("#test", "bob") || transport.InChannel("#other", "tim") {
+			t.Errorf("%T.InChannel() = true for a non-member", transport)
+		}
+		if members := transport.Members("#other"); members != nil {
+			t.Errorf("%T.Members() of a channel we are not in = %v", transport, members)
+		}
+	}
+}
@@ -6,26 +6,187 @@ import (
 )
 
 // All plugins should implement this interface
+//   Parse returns true if the plugin handled the message, in which case it
+//   isn't offered to the plugins after it. See GomrService.HandleMessage()
 type Plugin interface {
 	Register() error
-	Parse(string, string, string, *Connection) error // Parse(user, channel, msg, connection)
+	Parse(*Context) (bool, error)
 	Help() []string
 }
 
+// Plugins may implement this to be offered messages before (or after) others.
+//   Higher priorities go first, plugins without one have priority 0.
+//   Config.PluginOrder overrides it.
+type Prioritizer interface {
+	Priority() int
+}
+
+// Plugins whose type doesn't say what they are implement this to be called
+//   something else, see PluginName()
+type Namer interface {
+	PluginName() string
+}
+
 // This struct defines the yaml the configuration file must follow
 type Config struct {
-	Hostname string `yaml:"hostname"`
-	Port     string `yaml:"port"`
-	Password string `yaml:"password"`
-	Channel  string `yaml:"channel"`
-	Nick     string `yaml:"nick"`
-	Source   string `yaml:"source"`
+	Hostname string          `yaml:"hostname"`
+	Port     string          `yaml:"port"`
+	Channels []ChannelConfig `yaml:"channels"`
+	Nick     string          `yaml:"nick"`
+	Source   string          `yaml:"source"`
+
+	// Messages starting with the prefix are addressed to the bot in channels
+	//   without a prefix of their own, see ChannelConfig.Prefix
+	Prefix string `yaml:"prefix"`
+
+	// Tried in order if the nick is taken when connecting, see Connection.nextNick()
+	AltNicks []string `yaml:"altnicks"`
+
+	// Accounts allowed to use admin commands, e.g. merging karma. Only users
+	//   logged in to these accounts are trusted, see Connection.IsAdmin().
+	Admins []string `yaml:"admins"`
+
+	// Passwords may be read from a file or the environment, see ReadSecret().
+	//   The server password is sent with PASS, the NickServ password is used
+	//   to IDENTIFY once connected.
+	ServerPassword   string `yaml:"serverpassword"`
+	NickServPassword string `yaml:"nickservpassword"`
+
+	// Wait for NickServ to confirm we are identified before joining channels
+	WaitForIdentify bool `yaml:"waitforidentify"`
+
+	// TLS, see Config.TLSConfig()
+	TLS                   bool   `yaml:"tls"`
+	TLSCAFile             string `yaml:"tlscafile"`
+	TLSCertFile           string `yaml:"tlscertfile"`
+	TLSKeyFile            string `yaml:"tlskeyfile"`
+	TLSInsecureSkipVerify bool   `yaml:"tlsinsecureskipverify"`
+
+	// SASL, see registration.handleSASL(). The username defaults to the nick.
+	SASLMechanism string `yaml:"saslmechanism"`
+	SASLUsername  string `yaml:"saslusername"`
+	SASLPassword  string `yaml:"saslpassword"`
+
+	// Flood protection, send at most SendBurst lines at once and then
+	//   SendRate lines per second. See sendQueue.
+	SendBurst int     `yaml:"sendburst"`
+	SendRate  float64 `yaml:"sendrate"`
+
+	// Long messages are split into several lines, only MaxLines of which are
+	//   sent at once. The rest are sent when asked for with "more".
+	//   0 sends every line.
+	MaxLines int `yaml:"maxlines"`
+
+	// Seconds between our pings to the server, and how long it has to answer
+	//   before we reconnect. Defaults to 60 and 120.
+	PingInterval int `yaml:"pinginterval"`
+	PingTimeout  int `yaml:"pingtimeout"`
+
+	// Names of the plugins to enable, see RegisterPlugin(). All plugins are
+	//   enabled if empty. Channels may narrow it down, see ChannelConfig.Plugins
+	Plugins []string `yaml:"plugins"`
+
+	// Directory to load more plugins from, see LoadPlugins()
+	PluginDir string `yaml:"plugindir"`
+
+	// Plugins run as separate processes, see ExternalPlugin. They are enabled
+	//   by name like any other plugin.
+	ExternalPlugins []ExternalPluginConfig `yaml:"externalplugins"`
+
+	// Names of plugins to offer messages to first, in order, see PluginName().
+	//   The rest follow in order of their Priority().
+	PluginOrder []string `yaml:"pluginorder"`
+
+	// Number of messages handled at once, and seconds each plugin has to
+	//   handle one. Default to 4 and 30.
+	Workers       int `yaml:"workers"`
+	PluginTimeout int `yaml:"plugintimeout"`
+
+	// Number of consecutive reconnect attempts before giving up, 0 retries
+	//   forever. Registrations the server refuses are not retried, see Run()
+	MaxRetries int `yaml:"maxretries"`
+
+	// Factoid Plugin, words that are never facts, e.g. "why?". Defaults to
+	//   some question words.
+	FactoidBlacklist []string `yaml:"factoidblacklist"`
 
 	// Dictionary Plugin
 	WordnikAPIKey string `yaml:"wordnikapikey"`
 }
 
+// Configuration for each channel the bot joins
+type ChannelConfig struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"` // May be read from a file or the environment, see ReadSecret()
+
+	// Names of the plugins enabled in this channel, see PluginName().
+	//   Every plugin enabled in Config.Plugins is if this is empty.
+	Plugins []string `yaml:"plugins"`
+
+	// Messages starting with the prefix are treated as if they were addressed
+	//   to the bot, so with a prefix of "!", "!rank" is the same as "gomr: rank"
+	Prefix string `yaml:"prefix"`
+
+	// Karma and factoids are only shared between channels in the same namespace.
+	//   The default namespace is empty.
+	Namespace string `yaml:"namespace"`
+}
+
+// Returns the configuration for the named channel, or nil if the bot is not
+//   configured to join it.
+func (c *Config) ChannelConfig(name string) *ChannelConfig {
+	name = CanonicalizeIrcNick(name)
+	for i := range c.Channels {
+		if CanonicalizeIrcNick(c.Channels[i].Name) == name {
+			return &c.Channels[i]
+		}
+	}
+	return nil
+}
+
+// Returns the karma and factoid namespace of the named channel.
+//   Private messages and unknown channels use the default namespace.
+func (c *Config) Namespace(channel string) string {
+	if cc := c.ChannelConfig(channel); cc != nil {
+		return cc.Namespace
+	}
+	return ""
+}
+
+// Returns the prefix that addresses the bot in the named channel, or the
+//   default prefix for private messages and unknown channels
+func (c *Config) CommandPrefix(channel string) string {
+	if cc := c.ChannelConfig(channel); cc != nil && cc.Prefix != "" {
+		return cc.Prefix
+	}
+	return c.Prefix
+}
+
+// Returns true if the named plugin should receive messages from this channel
+func (cc *ChannelConfig) PluginEnabled(name string) bool {
+	if len(cc.Plugins) == 0 {
+		return true
+	}
+	for _, p := range cc.Plugins {
+		if strings.EqualFold(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Configuration of a plugin run as a separate process, see ExternalPlugin
+type ExternalPluginConfig struct {
+	Name    string   `yaml:"name"`
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+}
+
 type DbConfig struct {
+	// "mysql" (the default) or "sqlite3". SQLite only uses the name, as the
+	//   path of the database file, or ":memory:".
+	Driver string `yaml:"driver"`
+
 	Hostname string `yaml:"hostname"`
 	Port     string `yaml:"port"`
 	Username string `yaml:"username"`
@@ -1,6 +1,7 @@
 package gomr
 
 import (
+	"context"
 	"errors"
 	"github.com/golang/glog"
 	"io/ioutil"
@@ -8,12 +9,22 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// Requests taking longer than this are abandoned
+const httpTimeout = 30 * time.Second
+
+var httpClient = &http.Client{Timeout: httpTimeout}
+
 // GET provided url over tcp. Returns a string with the response body.
 func HttpGet(url string) (response []byte, err error) {
-	client := &http.Client{}
+	return HttpGetContext(context.Background(), url)
+}
 
+// HttpGetContext is HttpGet, abandoned early if ctx is done, e.g. when a
+//   plugin runs out of time
+func HttpGetContext(ctx context.Context, url string) (response []byte, err error) {
 	var req *http.Request
 	req, err = http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -21,7 +32,7 @@ func HttpGet(url string) (response []byte, err error) {
 	}
 
 	var resp *http.Response
-	resp, err = client.Do(req)
+	resp, err = httpClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return
 	}
@@ -85,7 +96,7 @@ func CanonicalizeIrcNick(nick string) string {
 		case r == '\\':
 			// '\' is uppercase '|'.
 			return '|'
-		case r > 'A' && r <= 'Z':
+		case r >= 'A' && r <= 'Z':
 			// Make uppercase letters lowercase.
 			return r + 32
 		case r > 32 && r < 127:
@@ -117,3 +128,8 @@ func addSuffix(num int) (fullNum string) {
 	fullNum = n + suffix
 	return
 }
+
+// Test if name is a channel rather than a nick
+func IsChannel(name string) bool {
+	return name != "" && strings.ContainsAny(name[:1], "#&+!")
+}